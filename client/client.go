@@ -0,0 +1,483 @@
+package client
+
+import (
+	"NetStore/internal"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultChunkSize     = 1 << 20
+	DefaultRetryDelay    = 250 * time.Millisecond
+	DefaultMaxRetryDelay = 30 * time.Second
+)
+
+type Checksum int
+
+const (
+	ChecksumCRC32C Checksum = iota
+	ChecksumSHA256
+	ChecksumNone
+)
+
+var checksumCapabilities = map[Checksum]uint32{
+	ChecksumCRC32C: internal.CapabilityChecksumCRC32C,
+	ChecksumSHA256: internal.CapabilityChecksumSHA256,
+	ChecksumNone:   0,
+}
+
+type Options struct {
+	TLSConfig          *tls.Config
+	Username           string
+	Password           string
+	Checksum           Checksum
+	DisableCompression bool
+	ChunkSize          uint64
+	Parallel           int
+	Timeout            time.Duration
+	MinTransferRate    uint64
+	MaxAttempts        int
+	RetryDelay         time.Duration
+	MaxRetryDelay      time.Duration
+	Progress           func(name string, transferred, size uint64)
+	OnRetry            func(err error, attempt int, delay time.Duration)
+}
+
+type FileInfo struct {
+	Name    string
+	Size    uint64
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+type Client struct {
+	address string
+	options Options
+	mutex   sync.Mutex
+	session *session
+	closed  bool
+}
+
+func New(address string, options Options) *Client {
+	if options.ChunkSize == 0 {
+		options.ChunkSize = DefaultChunkSize
+	}
+	if options.Parallel < 1 {
+		options.Parallel = 1
+	}
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = DefaultRetryDelay
+	}
+	if options.MaxRetryDelay <= 0 {
+		options.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	if options.MaxRetryDelay < options.RetryDelay {
+		options.MaxRetryDelay = options.RetryDelay
+	}
+	return &Client{address: address, options: options}
+}
+
+func (c *Client) capabilities() uint32 {
+	capabilities := internal.CapabilityUploads | checksumCapabilities[c.options.Checksum]
+	if !c.options.DisableCompression {
+		capabilities |= internal.CapabilityCompression
+	}
+	return capabilities
+}
+
+func (c *Client) progress(name string, transferred, size uint64) {
+	if c.options.Progress != nil {
+		c.options.Progress(name, transferred, size)
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (*session, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: c.options.Timeout}
+	if c.options.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.options.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", c.address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	server := newSession(conn, c.options.Timeout, c.options.MinTransferRate)
+	if err := server.setDeadline(0); err != nil {
+		_ = server.close()
+		return nil, err
+	}
+	return server, nil
+}
+
+func isHangUp(err error) bool {
+	return err == io.EOF || errors.Is(err, syscall.ECONNRESET)
+}
+
+func (c *Client) greet(ctx context.Context) (*session, error) {
+	server, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := server.watch(ctx)
+	err = hello(server, c.capabilities())
+	stop()
+	if err != nil {
+		_ = server.close()
+		return nil, contextError(ctx, err)
+	}
+	return server, nil
+}
+
+func (c *Client) connect(ctx context.Context) (*session, error) {
+	server, err := c.greet(ctx)
+	if isHangUp(err) {
+		server, err = c.greet(ctx)
+	}
+	if isHangUp(err) {
+		if server, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if c.options.Username != "" {
+		stop := server.watch(ctx)
+		err := authenticate(server, c.options.Username, c.options.Password)
+		stop()
+		if err != nil {
+			_ = server.close()
+			return nil, contextError(ctx, err)
+		}
+	}
+	return server, nil
+}
+
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return internal.TimeoutError(err)
+}
+
+func isRefusal(err error) bool {
+	var refusalErr *RefusalError
+	return errors.As(err, &refusalErr)
+}
+
+func isRetryableOp(opErr *net.OpError) bool {
+	switch opErr.Op {
+	case "dial", "read", "write", "readfrom":
+	default:
+		return false
+	}
+	return opErr.Timeout() ||
+		errors.Is(opErr.Err, syscall.ECONNREFUSED) ||
+		errors.Is(opErr.Err, syscall.ECONNRESET) ||
+		errors.Is(opErr.Err, syscall.EPIPE)
+}
+
+func isRetryable(err error) bool {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, ErrServerBusy):
+		return true
+	case isRefusal(err):
+		return false
+	case errors.Is(err, ErrReadTimeout), errors.Is(err, ErrWriteTimeout):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	return errors.As(err, &opErr) && isRetryableOp(opErr)
+}
+
+func (c *Client) retryDelay(attempt int) time.Duration {
+	delay := c.options.RetryDelay
+	for i := 1; i < attempt && delay < c.options.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > c.options.MaxRetryDelay {
+		delay = c.options.MaxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (c *Client) backoff(ctx context.Context, err error, attempt int) error {
+	delay := c.retryDelay(attempt)
+	if c.options.OnRetry != nil {
+		c.options.OnRetry(err, attempt, delay)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *Client) withSession(ctx context.Context, operation func(*session) error) error {
+	for attempt := 1; ; attempt++ {
+		err := c.attempt(ctx, operation)
+		if err == nil || attempt >= c.options.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+		if err := c.backoff(ctx, err, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, operation func(*session) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.session == nil {
+		server, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		c.session = server
+	}
+	if err := c.session.setDeadline(0); err != nil {
+		_ = c.session.close()
+		c.session = nil
+		return err
+	}
+	stop := c.session.watch(ctx)
+	err := operation(c.session)
+	stop()
+	if err != nil && (ctx.Err() != nil || !isRefusal(err)) {
+		_ = c.session.close()
+		c.session = nil
+	}
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	if c.session == nil {
+		return nil
+	}
+	err := c.session.close()
+	c.session = nil
+	return err
+}
+
+func (c *Client) Filenames(ctx context.Context) ([]string, error) {
+	var names []string
+	err := c.withSession(ctx, func(server *session) error {
+		filenames, err := getFilenames(server)
+		if err != nil {
+			return err
+		}
+		names = make([]string, 0, len(filenames))
+		for _, filename := range filenames {
+			names = append(names, string(filename))
+		}
+		return nil
+	})
+	return names, err
+}
+
+func newFileInfo(fileInfo internal.FileInfo) FileInfo {
+	return FileInfo{string(fileInfo.Name), fileInfo.Size, fileInfo.ModTime, fileInfo.Mode}
+}
+
+func (c *Client) List(ctx context.Context) ([]FileInfo, error) {
+	var files []FileInfo
+	err := c.withSession(ctx, func(server *session) error {
+		listing, err := getListing(server, internal.ListingFlagPermissions)
+		if err != nil {
+			return err
+		}
+		files = make([]FileInfo, 0, len(listing))
+		for _, fileInfo := range listing {
+			files = append(files, newFileInfo(fileInfo))
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (c *Client) Stat(ctx context.Context, name string) (FileInfo, error) {
+	var result FileInfo
+	err := c.withSession(ctx, func(server *session) error {
+		fileInfo, err := getFileInfo(server, []byte(name))
+		result = newFileInfo(fileInfo)
+		return err
+	})
+	return result, err
+}
+
+func (c *Client) Hash(ctx context.Context, name string) ([]byte, error) {
+	var digest []byte
+	err := c.withSession(ctx, func(server *session) error {
+		algorithm := internal.ChunkChecksumAlgorithm(server.capabilities)
+		if algorithm == 0 {
+			return ErrChecksumsDisabled
+		}
+		fileInfo, err := getFileInfo(server, []byte(name))
+		if err != nil {
+			return err
+		}
+		if err := server.setDeadline(fileInfo.Size); err != nil {
+			return err
+		}
+		digest, err = getFileHash(server, algorithm, []byte(name))
+		return err
+	})
+	return digest, err
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += uint64(n)
+	return n, err
+}
+
+func readChunk(server *session, filename []byte, offset, size, chunkSize uint64, writer *countingWriter) error {
+	for writer.written < size {
+		requestSize := chunkSize
+		if size-writer.written < requestSize {
+			requestSize = size - writer.written
+		}
+		received, err := getFileChunk(server, filename, offset+writer.written, requestSize, writer)
+		if writer.written > 0 && errors.Is(err, ErrBadOffset) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if received == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+func (c *Client) ReadChunk(ctx context.Context, name string, offset, size uint64, writer io.Writer) (uint64, error) {
+	counter := &countingWriter{writer: writer}
+	err := c.withSession(ctx, func(server *session) error {
+		return readChunk(server, []byte(name), offset, size, c.options.ChunkSize, counter)
+	})
+	return counter.written, err
+}
+
+type sliceWriter struct {
+	buff []byte
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	if len(p) > cap(w.buff)-len(w.buff) {
+		return 0, io.ErrShortWrite
+	}
+	w.buff = append(w.buff, p...)
+	return len(p), nil
+}
+
+func readAt(server *session, filename []byte, size, chunkSize uint64, buff []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrBadOffset
+	}
+	if uint64(off) >= size {
+		return 0, io.EOF
+	}
+	wanted := buff
+	if uint64(len(wanted)) > size-uint64(off) {
+		wanted = wanted[:size-uint64(off)]
+	}
+	writer := &sliceWriter{wanted[:0]}
+	for len(writer.buff) < len(wanted) {
+		offset := uint64(off) + uint64(len(writer.buff))
+		requestSize := chunkSize
+		if uint64(len(wanted)-len(writer.buff)) < requestSize {
+			requestSize = uint64(len(wanted) - len(writer.buff))
+		}
+		received, err := getFileChunk(server, filename, offset, requestSize, writer)
+		if err != nil {
+			return len(writer.buff), err
+		}
+		if received == 0 {
+			return len(writer.buff), io.ErrUnexpectedEOF
+		}
+	}
+	if len(wanted) < len(buff) {
+		return len(wanted), io.EOF
+	}
+	return len(wanted), nil
+}
+
+func (c *Client) ReadAt(ctx context.Context, name string, off int64, buff []byte) (int, error) {
+	read := 0
+	err := c.withSession(ctx, func(server *session) error {
+		fileInfo, err := getFileInfo(server, []byte(name))
+		if err != nil {
+			return err
+		}
+		n, err := readAt(server, []byte(name), fileInfo.Size, c.options.ChunkSize, buff[read:], off+int64(read))
+		read += n
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	if err == nil && read < len(buff) {
+		return read, io.EOF
+	}
+	return read, err
+}
+
+func (c *Client) Download(ctx context.Context, name, dst string) error {
+	resume := false
+	return c.withSession(ctx, func(server *session) error {
+		err := c.downloadFile(ctx, server, name, dst, resume)
+		resume = true
+		return err
+	})
+}
+
+func (c *Client) Resume(ctx context.Context, name, dst string) error {
+	return c.withSession(ctx, func(server *session) error {
+		return c.downloadFile(ctx, server, name, dst, true)
+	})
+}
+
+func (c *Client) Upload(ctx context.Context, src, name string) error {
+	var uploaded uint64 = 0
+	return c.withSession(ctx, func(server *session) error {
+		if server.capabilities&internal.CapabilityUploads == 0 {
+			return &RefusalError{Cause: internal.RefusalCauseReadOnly}
+		}
+		return uploadFile(server, src, []byte(name), uploaded, c.options.ChunkSize, func(sent, size uint64) {
+			uploaded = sent
+			c.progress(name, sent, size)
+		})
+	})
+}
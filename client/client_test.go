@@ -0,0 +1,157 @@
+package client
+
+import (
+	"NetStore/internal"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadAtBounds(t *testing.T) {
+	buff := make([]byte, 4)
+	if _, err := readAt(nil, []byte("file"), 10, DefaultChunkSize, buff, -1); err != ErrBadOffset {
+		t.Fatal("expected error not returned")
+	}
+	if read, err := readAt(nil, []byte("file"), 10, DefaultChunkSize, buff, 10); read != 0 || err != io.EOF {
+		t.Fatal("read", read, "bytes with error", err, ", expected 0 and EOF")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	netStore := New(ln.Addr().String(), Options{Timeout: 50 * time.Millisecond})
+	defer netStore.Close()
+	if _, err := netStore.Filenames(context.Background()); !errors.Is(err, ErrReadTimeout) {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func serveOversizedChunk(conn net.Conn, version uint16) error {
+	if _, err := internal.ReadRequestType(conn); err != nil {
+		return err
+	}
+	if _, err := internal.ReadHelloRequest(conn); err != nil {
+		return err
+	}
+	if err := internal.WriteHelloResponse(conn, version, 0); err != nil {
+		return err
+	}
+	if _, err := internal.ReadRequestType(conn); err != nil {
+		return err
+	}
+	chunk := bytes.NewReader(make([]byte, 100))
+	if version >= internal.ProtocolVersion2 {
+		if _, err := internal.ReadChunkRequestV2(conn); err != nil {
+			return err
+		}
+		return internal.WriteChunkResponseV2(conn, chunk, 100)
+	}
+	if _, err := internal.ReadChunkRequest(conn); err != nil {
+		return err
+	}
+	return internal.WriteChunkResponse(conn, chunk, 100)
+}
+
+func TestClientRejectsOversizedChunk(t *testing.T) {
+	for _, version := range []uint16{internal.ProtocolVersion1, internal.ProtocolVersion2} {
+		t.Run(fmt.Sprint("version ", version), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err == nil {
+					defer conn.Close()
+					if serveOversizedChunk(conn, version) == nil {
+						_, _ = io.Copy(ioutil.Discard, conn)
+					}
+				}
+			}()
+			netStore := New(ln.Addr().String(), Options{})
+			defer netStore.Close()
+			buffer := bytes.NewBuffer(nil)
+			received, err := netStore.ReadChunk(context.Background(), "file", 0, 10, buffer)
+			var protocolErr *ProtocolError
+			if !errors.As(err, &protocolErr) {
+				t.Fatal("read chunk with error", err, ", expected protocol error")
+			}
+			if received != 0 || buffer.Len() != 0 {
+				t.Fatal("received", received, "bytes, expected 0")
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	dataSets := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"busy", &RefusalError{Cause: internal.RefusalCauseBusy}, true},
+		{"bad filename", &RefusalError{Cause: internal.RefusalCauseBadFilename}, false},
+		{"bad offset", &RefusalError{Cause: internal.RefusalCauseBadOffset}, false},
+		{"read timeout", fmt.Errorf("%w: reading", ErrReadTimeout), true},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"broken pipe", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"tls alert", &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}, false},
+		{"unknown host", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "netstore.invalid"}}, false},
+		{"permission denied", &net.OpError{Op: "dial", Err: syscall.EACCES}, false},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"protocol", &ProtocolError{Message: "unexpected response type: 1"}, false},
+		{"no version", &NoVersionError{}, false},
+		{"cancelled", context.Canceled, false},
+		{"local file", &os.PathError{Op: "open", Path: "file", Err: os.ErrNotExist}, false},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			if retryable := isRetryable(dataSet.err); retryable != dataSet.retryable {
+				t.Fatal("retryable", retryable, ", expected", dataSet.retryable)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	netStore := New("", Options{RetryDelay: 100 * time.Millisecond, MaxRetryDelay: time.Second})
+	dataSets := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(fmt.Sprint("attempt ", dataSet.attempt), func(t *testing.T) {
+			delay := netStore.retryDelay(dataSet.attempt)
+			if delay < dataSet.max/2 || delay > dataSet.max {
+				t.Fatal("delay", delay, ", expected between", dataSet.max/2, "and", dataSet.max)
+			}
+		})
+	}
+}
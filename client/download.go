@@ -0,0 +1,235 @@
+package client
+
+import (
+	"NetStore/internal"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type chunkRange struct {
+	offset uint64
+	size   uint64
+	err    error
+}
+
+func loadDownloadState(statePath, filepath string, fileInfo internal.FileInfo) (internal.DownloadState, error) {
+	fresh := internal.DownloadState{Size: fileInfo.Size, ModTime: fileInfo.ModTime.UnixNano()}
+	state, err := internal.LoadDownloadState(statePath)
+	if os.IsNotExist(err) {
+		return fresh, nil
+	} else if err != nil {
+		return internal.DownloadState{}, err
+	}
+	if state.Size != fresh.Size || state.ModTime != fresh.ModTime {
+		return fresh, nil
+	}
+	stat, err := os.Stat(filepath)
+	if os.IsNotExist(err) {
+		return fresh, nil
+	} else if err != nil {
+		return internal.DownloadState{}, err
+	}
+	if uint64(stat.Size()) < state.Extent() {
+		return fresh, nil
+	}
+	return state, nil
+}
+
+func splitRanges(ranges []internal.Range, chunkSize uint64) []chunkRange {
+	chunks := make([]chunkRange, 0, len(ranges))
+	for _, missing := range ranges {
+		for offset := missing.Start; offset < missing.End; offset += chunkSize {
+			size := chunkSize
+			if missing.End-offset < size {
+				size = missing.End - offset
+			}
+			chunks = append(chunks, chunkRange{offset: offset, size: size})
+		}
+	}
+	return chunks
+}
+
+func writeFileChunk(
+	server *session,
+	filename []byte,
+	offset, chunkSize uint64,
+	filepath string,
+) (_ uint64, rerr error) {
+	file, err := internal.OpenFile(filepath, int64(offset), os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	counter := &countingWriter{writer: file}
+	_, err = getFileChunk(server, filename, offset, chunkSize, counter)
+	return counter.written, err
+}
+
+func fetchChunks(
+	server *session,
+	filename []byte,
+	filepath string,
+	chunks <-chan chunkRange,
+	results chan<- chunkRange,
+) {
+	for chunk := range chunks {
+		for chunk.size > 0 {
+			received, err := writeFileChunk(server, filename, chunk.offset, chunk.size, filepath)
+			if err == nil && received == 0 {
+				err = fmt.Errorf("server sent an empty chunk at offset %d", chunk.offset)
+			}
+			if err != nil {
+				results <- chunkRange{offset: chunk.offset, size: received, err: err}
+				return
+			}
+			results <- chunkRange{offset: chunk.offset, size: received}
+			chunk.offset += received
+			chunk.size -= received
+		}
+	}
+}
+
+func downloadChunks(
+	servers []*session,
+	filename []byte,
+	filepath string,
+	pending []chunkRange,
+	received func(offset, size uint64) error,
+) error {
+	chunks := make(chan chunkRange)
+	results := make(chan chunkRange)
+	done := make(chan struct{})
+	go func() {
+		defer close(chunks)
+		for _, chunk := range pending {
+			select {
+			case chunks <- chunk:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var workers sync.WaitGroup
+	for _, server := range servers {
+		workers.Add(1)
+		go func(server *session) {
+			defer workers.Done()
+			fetchChunks(server, filename, filepath, chunks, results)
+		}(server)
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	var firstErr error = nil
+	for result := range results {
+		var err error
+		if result.size > 0 {
+			err = received(result.offset, result.size)
+		}
+		if err == nil {
+			err = result.err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+			close(done)
+		}
+	}
+	return firstErr
+}
+
+func verifyFile(server *session, filename []byte, filepath string, size uint64) error {
+	algorithm := internal.ChunkChecksumAlgorithm(server.capabilities)
+	if algorithm == 0 {
+		return nil
+	}
+	if err := server.setDeadline(size); err != nil {
+		return err
+	}
+	expected, err := getFileHash(server, algorithm, filename)
+	if err != nil {
+		return err
+	}
+	digest, err := internal.FileChecksum(filepath, algorithm)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, expected) {
+		return fmt.Errorf("%w: %s differs from the server's copy", internal.ErrChecksumMismatch, filepath)
+	}
+	return nil
+}
+
+func (c *Client) downloadFile(ctx context.Context, server *session, name, filepath string, resume bool) (rerr error) {
+	filename := []byte(name)
+	fileInfo, err := getFileInfo(server, filename)
+	if err != nil {
+		return err
+	}
+	statePath := internal.DownloadStatePath(filepath)
+	state := internal.DownloadState{Size: fileInfo.Size, ModTime: fileInfo.ModTime.UnixNano()}
+	if resume {
+		if state, err = loadDownloadState(statePath, filepath, fileInfo); err != nil {
+			return err
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY
+	if len(state.Ranges) == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := internal.OpenFile(filepath, 0, flags)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := state.Save(statePath); err != nil {
+		return err
+	}
+	pending := splitRanges(state.Missing(), c.options.ChunkSize)
+	servers := []*session{server}
+	for len(servers) < c.options.Parallel && len(servers) < len(pending) {
+		extra, err := c.connect(ctx)
+		if errors.Is(err, ErrServerBusy) {
+			break
+		} else if err != nil {
+			return err
+		}
+		defer func() {
+			if err := extra.close(); err != nil && rerr == nil {
+				rerr = err
+			}
+		}()
+		defer extra.watch(ctx)()
+		servers = append(servers, extra)
+	}
+	c.progress(name, state.Completed(), state.Size)
+	err = downloadChunks(servers, filename, filepath, pending, func(offset, size uint64) error {
+		state.Add(offset, offset+size)
+		c.progress(name, state.Completed(), state.Size)
+		return state.Save(statePath)
+	})
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(filepath); err != nil {
+		return err
+	} else if len(state.Missing()) != 0 || uint64(stat.Size()) != state.Size {
+		_ = os.Remove(statePath)
+		return fmt.Errorf("reassembled %s has %d bytes, expected %d", filepath, stat.Size(), state.Size)
+	}
+	if err := verifyFile(server, filename, filepath, state.Size); err != nil {
+		_ = os.Remove(statePath)
+		return err
+	}
+	return os.Remove(statePath)
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"NetStore/internal"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadFilename       = internal.ErrBadFilename
+	ErrBadOffset         = internal.ErrBadOffset
+	ErrBadSize           = internal.ErrBadSize
+	ErrReadOnly          = internal.ErrReadOnly
+	ErrUnauthenticated   = internal.ErrUnauthenticated
+	ErrForbidden         = internal.ErrForbidden
+	ErrServerBusy        = internal.ErrServerBusy
+	ErrChecksumMismatch  = internal.ErrChecksumMismatch
+	ErrReadTimeout       = internal.ErrReadTimeout
+	ErrWriteTimeout      = internal.ErrWriteTimeout
+	ErrChecksumsDisabled = errors.New("checksums are disabled or not supported by the server")
+	ErrClosed            = errors.New("client is closed")
+)
+
+type RefusalError = internal.RefusalError
+
+type ProtocolError = internal.ProtocolError
+
+type NoVersionError struct {
+	MinVersion uint16
+	MaxVersion uint16
+}
+
+func (e *NoVersionError) Error() string {
+	return fmt.Sprintf(
+		"server refused: protocol versions %d-%d supported by the server, %d-%d by the client",
+		e.MinVersion,
+		e.MaxVersion,
+		internal.ProtocolVersion1,
+		internal.LatestProtocolVersion,
+	)
+}
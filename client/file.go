@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+type File struct {
+	client *Client
+	name   string
+	size   uint64
+	offset int64
+}
+
+func (c *Client) Open(name string) (*File, error) {
+	fileInfo, err := c.Stat(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{c, name, fileInfo.Size, 0}, nil
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Size() int64 {
+	return int64(f.size)
+}
+
+func (f *File) ReadAt(buff []byte, off int64) (int, error) {
+	read := 0
+	err := f.client.withSession(context.Background(), func(server *session) error {
+		n, err := readAt(server, []byte(f.name), f.size, f.client.options.ChunkSize, buff[read:], off+int64(read))
+		read += n
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	if err == nil && read < len(buff) {
+		return read, io.EOF
+	}
+	return read, err
+}
+
+func (f *File) Read(buff []byte) (int, error) {
+	if len(buff) == 0 {
+		return 0, nil
+	}
+	read, err := f.ReadAt(buff, f.offset)
+	f.offset += int64(read)
+	if err == io.EOF && read > 0 {
+		err = nil
+	}
+	return read, err
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.size)
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,392 @@
+package client
+
+import (
+	"NetStore/internal"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const legacyCapabilities = internal.CapabilityUploads
+
+type session struct {
+	*bufio.ReadWriter
+	conn         net.Conn
+	version      uint16
+	capabilities uint32
+	negotiated   bool
+	timeout      time.Duration
+	minRate      uint64
+	mutex        sync.Mutex
+	cancelled    bool
+}
+
+func newSession(conn net.Conn, timeout time.Duration, minRate uint64) *session {
+	readWriter := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return &session{
+		ReadWriter:   readWriter,
+		conn:         conn,
+		version:      internal.ProtocolVersion1,
+		capabilities: legacyCapabilities,
+		timeout:      timeout,
+		minRate:      minRate,
+	}
+}
+
+func (s *session) setDeadline(size uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cancelled {
+		return s.conn.SetDeadline(time.Now())
+	}
+	return s.conn.SetDeadline(internal.TransferDeadline(s.timeout, s.minRate, size))
+}
+
+func (s *session) cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cancelled = true
+	_ = s.conn.SetDeadline(time.Now())
+}
+
+func (s *session) close() error {
+	return s.conn.Close()
+}
+
+func (s *session) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			s.cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func readResponseType(reader io.Reader, expected uint16) error {
+	responseType, err := internal.ReadResponseType(reader)
+	if err != nil {
+		return err
+	}
+	if responseType == internal.ResponseTypeRefusal {
+		cause, err := internal.ReadRefusal(reader)
+		if err != nil {
+			return err
+		}
+		return &RefusalError{Cause: cause}
+	}
+	if responseType != expected {
+		return &ProtocolError{Message: fmt.Sprint("unexpected response type: ", responseType)}
+	}
+	return nil
+}
+
+func fitsVersion1(values ...uint64) bool {
+	for _, value := range values {
+		if value > uint64(^uint32(0)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *session) writeChunkRequest(offset, size uint64, filename []byte) error {
+	if s.version >= internal.ProtocolVersion2 {
+		return internal.WriteChunkRequestV2(s, offset, size, filename)
+	}
+	if !fitsVersion1(offset, size) {
+		return fmt.Errorf("server supports only 32-bit offsets and sizes, requested %d bytes at offset %d", size, offset)
+	}
+	return internal.WriteChunkRequest(s, uint32(offset), uint32(size), filename)
+}
+
+func (s *session) readEncodedChunk(writer io.Writer, limit uint64) (uint64, error) {
+	encoding, err := internal.ReadChunkEncoding(s)
+	if err != nil {
+		return 0, err
+	}
+	if encoding == internal.ChunkEncodingIdentity {
+		return internal.ReadChunkResponseV2(s, writer, limit)
+	}
+	compressed := bytes.NewBuffer(nil)
+	if _, err := internal.ReadChunkResponseV2(s, compressed, limit); err != nil {
+		return 0, err
+	}
+	return internal.DecompressChunk(compressed, writer, limit)
+}
+
+func (s *session) readChunkPayload(writer io.Writer, limit uint64) (uint64, error) {
+	if s.capabilities&internal.CapabilityCompression != 0 {
+		return s.readEncodedChunk(writer, limit)
+	}
+	if s.version >= internal.ProtocolVersion2 {
+		return internal.ReadChunkResponseV2(s, writer, limit)
+	}
+	size, err := internal.ReadChunkResponse(s, writer, uint32(limit))
+	return uint64(size), err
+}
+
+func (s *session) readChunkResponse(writer io.Writer, limit uint64) (uint64, error) {
+	algorithm := internal.ChunkChecksumAlgorithm(s.capabilities)
+	if algorithm == 0 {
+		return s.readChunkPayload(writer, limit)
+	}
+	checksum, err := internal.NewChecksum(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	chunk := bytes.NewBuffer(nil)
+	size, err := s.readChunkPayload(io.MultiWriter(chunk, checksum), limit)
+	if err != nil {
+		return 0, err
+	}
+	received := make([]byte, checksum.Size())
+	if _, err := io.ReadFull(s, received); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(received, checksum.Sum(nil)) {
+		return 0, fmt.Errorf("%w in chunk of %d bytes", internal.ErrChecksumMismatch, size)
+	}
+	if _, err := chunk.WriteTo(writer); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *session) writeUploadRequest(flags uint16, offset, size uint64, filename []byte, reader io.Reader) error {
+	if s.version >= internal.ProtocolVersion2 {
+		return internal.WriteUploadRequestV2(s, flags, offset, size, filename, reader)
+	}
+	if !fitsVersion1(offset, size) {
+		return fmt.Errorf("server supports only 32-bit offsets and sizes, sending %d bytes at offset %d", size, offset)
+	}
+	return internal.WriteUploadRequest(s, flags, uint32(offset), uint32(size), filename, reader)
+}
+
+func authenticate(server *session, username, password string) error {
+	if err := internal.WriteAuthRequest(server, []byte(username)); err != nil {
+		return err
+	}
+	if err := server.Flush(); err != nil {
+		return err
+	}
+	if err := readResponseType(server, internal.ResponseTypeChallenge); err != nil {
+		return err
+	}
+	challenge, err := internal.ReadChallenge(server)
+	if err != nil {
+		return err
+	}
+	if err := internal.WriteAuthProof(server, internal.AuthProof([]byte(password), challenge)); err != nil {
+		return err
+	}
+	if err := server.Flush(); err != nil {
+		return err
+	}
+	return readResponseType(server, internal.ResponseTypeAuth)
+}
+
+func hello(server *session, capabilities uint32) error {
+	err := internal.WriteHelloRequest(server, internal.ProtocolVersion1, internal.LatestProtocolVersion, capabilities)
+	if err != nil {
+		return err
+	}
+	if err := server.Flush(); err != nil {
+		return err
+	}
+	responseType, err := internal.ReadResponseType(server)
+	if err != nil {
+		return err
+	}
+	if responseType == internal.ResponseTypeRefusal {
+		cause, err := internal.ReadRefusal(server)
+		if err != nil {
+			return err
+		}
+		return &RefusalError{Cause: cause}
+	}
+	if responseType == internal.ResponseTypeNoVersion {
+		response, err := internal.ReadNoVersionResponse(server)
+		if err != nil {
+			return err
+		}
+		return &NoVersionError{response.MinVersion, response.MaxVersion}
+	}
+	if responseType != internal.ResponseTypeHello {
+		return &ProtocolError{Message: fmt.Sprint("unexpected response type: ", responseType)}
+	}
+	response, err := internal.ReadHelloResponse(server)
+	if err != nil {
+		return err
+	}
+	server.version = response.Version
+	server.capabilities = response.Capabilities
+	server.negotiated = true
+	return nil
+}
+
+func getFilenames(server *session) ([][]byte, error) {
+	if err := internal.WriteFilenamesRequest(server); err != nil {
+		return nil, err
+	}
+	if err := server.Flush(); err != nil {
+		return nil, err
+	}
+	if err := readResponseType(server, internal.ResponseTypeFilenames); err != nil {
+		return nil, err
+	}
+	response, err := internal.ReadFilenamesResponse(server)
+	if err != nil {
+		return nil, err
+	}
+	return response.Filenames, nil
+}
+
+func getListing(server *session, flags uint16) ([]internal.FileInfo, error) {
+	if err := internal.WriteListingRequest(server, internal.ListingVersion1, flags); err != nil {
+		return nil, err
+	}
+	if err := server.Flush(); err != nil {
+		return nil, err
+	}
+	if err := readResponseType(server, internal.ResponseTypeListing); err != nil {
+		return nil, err
+	}
+	response, err := internal.ReadListingResponse(server)
+	if err != nil {
+		return nil, err
+	}
+	return response.Files, nil
+}
+
+func getFileSize(server *session, filename []byte) (uint64, error) {
+	if err := internal.WriteFileSizeRequest(server, filename); err != nil {
+		return 0, err
+	}
+	if err := server.Flush(); err != nil {
+		return 0, err
+	}
+	if err := readResponseType(server, internal.ResponseTypeFileSize); err != nil {
+		return 0, err
+	}
+	return internal.ReadFileSizeResponse(server)
+}
+
+func getFileInfo(server *session, filename []byte) (internal.FileInfo, error) {
+	if !server.negotiated {
+		size, err := getFileSize(server, filename)
+		return internal.FileInfo{Name: filename, Size: size}, err
+	}
+	if err := internal.WriteFileInfoRequest(server, filename); err != nil {
+		return internal.FileInfo{}, err
+	}
+	if err := server.Flush(); err != nil {
+		return internal.FileInfo{}, err
+	}
+	if err := readResponseType(server, internal.ResponseTypeFileInfo); err != nil {
+		return internal.FileInfo{}, err
+	}
+	fileInfo, err := internal.ReadFileInfoResponse(server)
+	fileInfo.Name = filename
+	return fileInfo, err
+}
+
+func getFileHash(server *session, algorithm uint32, filename []byte) ([]byte, error) {
+	if err := internal.WriteFileHashRequest(server, algorithm, filename); err != nil {
+		return nil, err
+	}
+	if err := server.Flush(); err != nil {
+		return nil, err
+	}
+	if err := readResponseType(server, internal.ResponseTypeFileHash); err != nil {
+		return nil, err
+	}
+	return internal.ReadFileHashResponse(server)
+}
+
+func getFileChunk(server *session, filename []byte, offset, chunkSize uint64, writer io.Writer) (uint64, error) {
+	if err := server.setDeadline(chunkSize); err != nil {
+		return 0, err
+	}
+	if err := server.writeChunkRequest(offset, chunkSize, filename); err != nil {
+		return 0, err
+	}
+	if err := server.Flush(); err != nil {
+		return 0, err
+	}
+	err := readResponseType(server, internal.ResponseTypeChunk)
+	var received uint64 = 0
+	if err == nil {
+		received, err = server.readChunkResponse(writer, chunkSize)
+	}
+	if err == io.EOF {
+		return received, io.ErrUnexpectedEOF
+	}
+	return received, err
+}
+
+func uploadFile(
+	server *session,
+	filepath string,
+	filename []byte,
+	offset, chunkSize uint64,
+	progress func(sent, size uint64),
+) (rerr error) {
+	file, err := internal.OpenFile(filepath, int64(offset), os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(stat.Size())
+	sent := offset
+	flags := internal.UploadFlagTruncate
+	progress(sent, size)
+	for {
+		requestSize := chunkSize
+		if size-sent < requestSize {
+			requestSize = size - sent
+		}
+		if err := server.setDeadline(requestSize); err != nil {
+			return err
+		}
+		if err := server.writeUploadRequest(flags, sent, requestSize, filename, file); err != nil {
+			return err
+		}
+		if err := server.Flush(); err != nil {
+			return err
+		}
+		if err := readResponseType(server, internal.ResponseTypeUpload); err != nil {
+			return err
+		}
+		flags = 0
+		sent += requestSize
+		progress(sent, size)
+		if sent >= size {
+			return nil
+		}
+	}
+}
@@ -1,38 +1,113 @@
-package client
+package main
 
 import (
+	"NetStore/client"
 	"NetStore/internal"
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"math"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 )
 
-func getFilenames(readwriter *bufio.ReadWriter) ([][]byte, error) {
-	if err := internal.WriteFilenamesRequest(readwriter); err != nil {
-		return nil, err
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitRefused = 3
+	passwordEnv = "NETSTORE_PASSWORD"
+)
+
+var checksums = map[string]client.Checksum{
+	"none":   client.ChecksumNone,
+	"crc32c": client.ChecksumCRC32C,
+	"sha256": client.ChecksumSHA256,
+}
+
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+type connector struct {
+	serverAddress string
+	options       client.Options
+}
+
+func (c connector) connect(options client.Options) *client.Client {
+	options.TLSConfig = c.options.TLSConfig
+	options.Username = c.options.Username
+	options.Password = c.options.Password
+	options.Checksum = c.options.Checksum
+	options.DisableCompression = c.options.DisableCompression
+	options.Timeout = c.options.Timeout
+	options.MinTransferRate = c.options.MinTransferRate
+	options.MaxAttempts = c.options.MaxAttempts
+	options.RetryDelay = c.options.RetryDelay
+	options.MaxRetryDelay = c.options.MaxRetryDelay
+	options.OnRetry = c.options.OnRetry
+	return client.New(c.serverAddress, options)
+}
+
+func closeClient(netStore *client.Client, rerr *error) {
+	if err := netStore.Close(); err != nil && *rerr == nil {
+		*rerr = err
 	}
-	if err := readwriter.Flush(); err != nil {
-		return nil, err
+}
+
+type chunkFile struct {
+	filepath string
+	offset   int64
+	file     *os.File
+}
+
+func (f *chunkFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		file, err := internal.OpenFile(f.filepath, f.offset, os.O_CREATE|os.O_WRONLY)
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
 	}
-	response, err := internal.ReadFilenamesResponse(readwriter)
-	if err != nil {
-		return nil, err
+	return f.file.Write(p)
+}
+
+func (f *chunkFile) Close() error {
+	if f.file == nil {
+		return nil
 	}
-	return response.Filenames, nil
+	return f.file.Close()
+}
+
+func getFileChunk(netStore *client.Client, filename string, offset, chunkSize uint64, filepath string) (rerr error) {
+	file := &chunkFile{filepath: filepath, offset: int64(offset)}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	_, err := netStore.ReadChunk(context.Background(), filename, offset, chunkSize, file)
+	return err
 }
 
-func getNumberInRange(message string, min, max uint32) uint32 {
-	reader := bufio.NewReader(os.Stdin)
+func getNumberInRange(reader *bufio.Reader, message string, min, max uint64) (uint64, error) {
 	for {
 		fmt.Print(message)
-		text, _ := reader.ReadString('\n')
-		parsedNumber, err := strconv.ParseUint(text, 10, 32)
-		number := uint32(parsedNumber)
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		number, err := strconv.ParseUint(strings.TrimSpace(text), 10, 64)
 		if err != nil {
 			fmt.Println("Parsing failed: ", err)
 		} else if number < min {
@@ -40,68 +115,358 @@ func getNumberInRange(message string, min, max uint32) uint32 {
 		} else if number > max {
 			fmt.Println("Value to big, maximal value is ", max)
 		} else {
-			return number
+			return number, nil
 		}
 	}
 }
 
-func getFileChunk(readwriter *bufio.ReadWriter, filename []byte, offset, chunkSize uint32) (rerr error) {
-	if err := internal.WriteChunkRequest(readwriter, offset, chunkSize, filename); err != nil {
+func printProgress(filename string, transferred, size uint64) {
+	percent := uint64(100)
+	if size != 0 {
+		percent = transferred * 100 / size
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %d/%d bytes (%d%%)", filename, transferred, size, percent)
+	if transferred == size {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func printRetry(err error, attempt int, delay time.Duration) {
+	fmt.Fprintf(os.Stderr, "\nAttempt %d failed: %v, retrying in %v\n", attempt, err, delay.Round(time.Millisecond))
+}
+
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	positional := make([]string, 0, len(args))
+	for {
+		if err := flags.Parse(args); err == flag.ErrHelp {
+			return nil, err
+		} else if err != nil {
+			return nil, usageError{err.Error()}
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runList(c connector, args []string) (rerr error) {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	long := flags.Bool("l", false, "print permissions, size and modification time of every file")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
 		return err
 	}
-	if err := readwriter.Flush(); err != nil {
+	if len(positional) != 0 {
+		return usageError{"list takes no arguments"}
+	}
+	netStore := c.connect(client.Options{})
+	defer closeClient(netStore, &rerr)
+	if !*long {
+		filenames, err := netStore.Filenames(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, filename := range filenames {
+			fmt.Println(filename)
+		}
+		return nil
+	}
+	files, err := netStore.List(context.Background())
+	if err != nil {
 		return err
 	}
-	filepath := path.Join(internal.ReceivedFilesDir, string(filename))
-	file, err := internal.OpenFile(filepath, int64(offset), os.O_CREATE|os.O_WRONLY)
+	for _, file := range files {
+		fmt.Printf(
+			"%v %12d %s %s\n",
+			file.Mode,
+			file.Size,
+			file.ModTime.Format("2006-01-02 15:04:05"),
+			file.Name,
+		)
+	}
+	return nil
+}
+
+func runGet(c connector, args []string) (rerr error) {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	offset := flags.Uint64("offset", 0, "chunk offset")
+	size := flags.Uint64("size", 0, "chunk size")
+	out := flags.String("out", "", "output file path, defaults to the filename inside "+internal.ReceivedFilesDir)
+	positional, err := parseArgs(flags, args)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := file.Close(); err != nil && rerr == nil {
-			rerr = err
+	if len(positional) != 1 {
+		return usageError{"get takes exactly one filename"}
+	}
+	if *size == 0 || *size > math.MaxInt64 {
+		return usageError{fmt.Sprint("size must be between 1 and ", int64(math.MaxInt64))}
+	}
+	filename := positional[0]
+	filepath := *out
+	if filepath == "" {
+		if !internal.IsValidPath([]byte(filename)) {
+			return usageError{fmt.Sprint("invalid filename: ", filename)}
 		}
-	}()
-	_, err = internal.ReadChunkResponse(readwriter, file)
-	return err
+		if filepath, err = internal.ReceivedFilePath(filename); err != nil {
+			return err
+		}
+	}
+	netStore := c.connect(client.Options{})
+	defer closeClient(netStore, &rerr)
+	return getFileChunk(netStore, filename, *offset, *size, filepath)
 }
 
-func main() {
-	serverAddress := flag.String(
-		"server",
-		fmt.Sprint("127.0.0.1:", internal.DefaultPort),
-		"server address with port number",
-	)
-	flag.Parse()
-	if err := internal.CreateReceivedFilesDir(); err != nil {
-		log.Fatal("Could not create directory", internal.ReceivedFilesDir, ":", err)
+func runHash(c connector, args []string) (rerr error) {
+	flags := flag.NewFlagSet("hash", flag.ContinueOnError)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
 	}
-	conn, err := net.Dial("tcp", *serverAddress)
+	if len(positional) != 1 {
+		return usageError{"hash takes exactly one filename"}
+	}
+	netStore := c.connect(client.Options{})
+	defer closeClient(netStore, &rerr)
+	digest, err := netStore.Hash(context.Background(), positional[0])
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Fatal(err)
+	fmt.Printf("%x  %s\n", digest, positional[0])
+	return nil
+}
+
+func runDownload(c connector, args []string) error {
+	return download(c, "download", args, false)
+}
+
+func runResume(c connector, args []string) error {
+	return download(c, "resume", args, true)
+}
+
+func download(c connector, command string, args []string, resume bool) (rerr error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	chunkSize := flags.Uint64("chunk-size", 1<<20, "size of the requested chunks")
+	out := flags.String("out", "", "output file path, defaults to the filename inside "+internal.ReceivedFilesDir)
+	quiet := flags.Bool("quiet", false, "do not report progress")
+	parallel := flags.Int("parallel", 1, "maximal number of connections fetching chunks concurrently")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError{command + " takes exactly one filename"}
+	}
+	if *parallel < 1 {
+		return usageError{"parallel must be at least 1"}
+	}
+	if *chunkSize == 0 || *chunkSize > math.MaxInt64 {
+		return usageError{fmt.Sprint("chunk size must be between 1 and ", int64(math.MaxInt64))}
+	}
+	filename := positional[0]
+	filepath := *out
+	if filepath == "" {
+		if !internal.IsValidPath([]byte(filename)) {
+			return usageError{fmt.Sprint("invalid filename: ", filename)}
 		}
-	}()
-	server := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	filenames, err := getFilenames(server)
+		if filepath, err = internal.ReceivedFilePath(filename); err != nil {
+			return err
+		}
+	}
+	options := client.Options{ChunkSize: *chunkSize, Parallel: *parallel, Progress: printProgress}
+	if *quiet {
+		options.Progress = nil
+	}
+	netStore := c.connect(options)
+	defer closeClient(netStore, &rerr)
+	if resume {
+		return netStore.Resume(context.Background(), filename, filepath)
+	}
+	return netStore.Download(context.Background(), filename, filepath)
+}
+
+func runPut(c connector, args []string) (rerr error) {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	chunkSize := flags.Uint64("chunk-size", 1<<20, "size of the uploaded chunks")
+	name := flags.String("name", "", "filename on the server, defaults to the base name of the local file")
+	quiet := flags.Bool("quiet", false, "do not report progress")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError{"put takes exactly one file path"}
+	}
+	if *chunkSize == 0 || *chunkSize > math.MaxInt64 {
+		return usageError{fmt.Sprint("chunk size must be between 1 and ", int64(math.MaxInt64))}
+	}
+	filepath := positional[0]
+	filename := *name
+	if filename == "" {
+		filename = path.Base(filepath)
+	}
+	if !internal.IsValidPath([]byte(filename)) {
+		return usageError{fmt.Sprint("invalid filename: ", filename)}
+	}
+	options := client.Options{ChunkSize: *chunkSize, Progress: printProgress}
+	if *quiet {
+		options.Progress = nil
+	}
+	netStore := c.connect(options)
+	defer closeClient(netStore, &rerr)
+	return netStore.Upload(context.Background(), filepath, filename)
+}
+
+func runShell(c connector, args []string) (rerr error) {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError{"shell takes no arguments"}
+	}
+	netStore := c.connect(client.Options{})
+	defer closeClient(netStore, &rerr)
+	filenames, err := netStore.Filenames(context.Background())
 	if err != nil {
-		log.Fatal("Could not get filenames: ", err)
+		return err
 	}
 	if len(filenames) == 0 {
 		fmt.Println("No files available.")
-		return
+		return nil
 	}
 	fmt.Println("Available files:")
 	for i, filename := range filenames {
-		fmt.Println(i, string(filename))
+		fmt.Println(i+1, filename)
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	fileNumber, err := getNumberInRange(stdin, "Choose file number: ", 1, uint64(len(filenames)))
+	if err != nil {
+		return err
+	}
+	offset, err := getNumberInRange(stdin, "Choose chunk offset: ", 0, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	chunkSize, err := getNumberInRange(stdin, "Choose chunk size: ", 1, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	filename := filenames[fileNumber-1]
+	filepath, err := internal.ReceivedFilePath(filename)
+	if err != nil {
+		return err
+	}
+	return getFileChunk(netStore, filename, offset, chunkSize, filepath)
+}
+
+func usage() {
+	output := flag.CommandLine.Output()
+	fmt.Fprintf(output, "Usage: %s [flags] <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(output, "Commands:")
+	fmt.Fprintln(output, "  list [-l]                                                            list files available on the server")
+	fmt.Fprintln(output, "  get <name> [-offset N] [-size N] [-out path]                         download a file chunk")
+	fmt.Fprintln(output, "  download <name> [-chunk-size N] [-parallel N] [-out path] [-quiet]   download a whole file")
+	fmt.Fprintln(output, "  resume <name> [-chunk-size N] [-parallel N] [-out path] [-quiet]     continue an interrupted download")
+	fmt.Fprintln(output, "  hash <name>                                                          print the checksum of a file")
+	fmt.Fprintln(output, "  put <path> [-chunk-size N] [-name name] [-quiet]                     upload a file")
+	fmt.Fprintln(output, "  shell                                                                choose a file chunk interactively")
+	fmt.Fprintln(output, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func exitCode(err error) int {
+	var usageErr usageError
+	var refusalErr *client.RefusalError
+	var noVersionErr *client.NoVersionError
+	switch {
+	case err == nil:
+		return exitSuccess
+	case err == flag.ErrHelp:
+		flag.Usage()
+		return exitSuccess
+	case errors.As(err, &usageErr):
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		return exitUsage
+	case errors.As(err, &refusalErr), errors.As(err, &noVersionErr):
+		fmt.Fprintln(os.Stderr, err)
+		return exitRefused
+	default:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitFailure
+	}
+}
+
+func main() {
+	serverAddress := flag.String(
+		"server",
+		fmt.Sprint("127.0.0.1:", internal.DefaultPort),
+		"server address with port number",
+	)
+	username := flag.String("user", "", "username used to authenticate")
+	password := flag.String("password", "", "password used to authenticate, defaults to "+passwordEnv+" variable")
+	compression := flag.Bool("compression", true, "accept compressed chunks")
+	timeout := flag.Duration("timeout", 30*time.Second, "time given to every request to complete, 0 to disable")
+	minTransferRate := flag.Uint64("min-transfer-rate", 64<<10, "minimal transfer rate in bytes per second, extends timeouts of chunks and uploads by their size")
+	attempts := flag.Int("attempts", 5, "maximal number of attempts of an operation failing with a connection error, timeout or busy server")
+	retryDelay := flag.Duration("retry-delay", 500*time.Millisecond, "delay before the first retry, doubled with every next one")
+	maxRetryDelay := flag.Duration("max-retry-delay", 30*time.Second, "maximal delay between retries")
+	checksum := flag.String("checksum", "crc32c", "checksum verifying received chunks and files: none, crc32c or sha256")
+	useTLS := flag.Bool("tls", false, "connect using TLS, implied by other TLS flags")
+	var tlsOptions internal.ClientTLSOptions
+	flag.StringVar(&tlsOptions.CAFile, "tls-ca", "", "path to PEM encoded CA certificates used to verify the server")
+	flag.StringVar(&tlsOptions.Pin, "tls-pin", "", "hex encoded SHA-256 fingerprint of the server certificate, replaces CA verification")
+	flag.StringVar(&tlsOptions.CertFile, "tls-cert", "", "path to PEM encoded client certificate")
+	flag.StringVar(&tlsOptions.KeyFile, "tls-key", "", "path to PEM encoded client private key")
+	flag.StringVar(&tlsOptions.ServerName, "tls-server-name", "", "server name used to verify the server certificate")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	c := connector{serverAddress: *serverAddress}
+	c.options.Username = *username
+	c.options.Password = *password
+	if c.options.Password == "" {
+		c.options.Password = os.Getenv(passwordEnv)
+	}
+	var ok bool
+	if c.options.Checksum, ok = checksums[*checksum]; !ok {
+		os.Exit(exitCode(usageError{fmt.Sprint("unknown checksum: ", *checksum)}))
+	}
+	c.options.DisableCompression = !*compression
+	c.options.Timeout = *timeout
+	c.options.MinTransferRate = *minTransferRate
+	c.options.MaxAttempts = *attempts
+	c.options.RetryDelay = *retryDelay
+	c.options.MaxRetryDelay = *maxRetryDelay
+	c.options.OnRetry = printRetry
+	if *useTLS || tlsOptions != (internal.ClientTLSOptions{}) {
+		tlsConfig, err := internal.ClientTLSConfig(tlsOptions)
+		if err != nil {
+			os.Exit(exitCode(err))
+		}
+		c.options.TLSConfig = tlsConfig
+	}
+	commands := map[string]func(connector, []string) error{
+		"list":     runList,
+		"get":      runGet,
+		"download": runDownload,
+		"resume":   runResume,
+		"hash":     runHash,
+		"put":      runPut,
+		"shell":    runShell,
 	}
-	fileNumber := getNumberInRange("Choose file number: ", 1, uint32(len(filenames))-1)
-	offset := getNumberInRange("Choose chunk offset: ", 0, ^uint32(0))
-	chunkSize := getNumberInRange("Choose chunk size: ", 1, ^uint32(0))
-	if err := getFileChunk(server, filenames[fileNumber-1], offset, chunkSize); err != nil {
-		log.Fatal("Could not get file chunk: ", err)
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		os.Exit(exitCode(usageError{fmt.Sprint("unknown command: ", flag.Arg(0))}))
 	}
+	os.Exit(exitCode(command(c, flag.Args()[1:])))
 }
@@ -1,101 +1,173 @@
-package server
+package main
 
 import (
 	"NetStore/internal"
-	"bufio"
-	"bytes"
+	"NetStore/server"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
-func handleChunkRequest(readWriter io.ReadWriter, files []internal.FileInfo) error {
-	request, err := internal.ReadChunkRequest(readWriter)
-	if err != nil {
-		return err
+type dirsFlag []string
+
+func (dirs *dirsFlag) String() string {
+	return strings.Join(*dirs, ",")
+}
+
+func (dirs *dirsFlag) Set(dir string) error {
+	*dirs = append(*dirs, dir)
+	return nil
+}
+
+func openStorage(dirpaths []string, recursive, memory bool) (server.Storage, []*server.DirStorage, error) {
+	if memory {
+		return server.NewMemoryStorage(), nil, nil
 	}
-	if request.Size == 0 {
-		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadSize)
+	if len(dirpaths) == 0 {
+		dirpaths = []string{"."}
 	}
-	for _, fileInfo := range files {
-		if bytes.Equal(request.Filename, fileInfo.Name) {
-			if uint64(request.Offset) >= fileInfo.Size {
-				return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
-			}
-			file, err := internal.OpenFile(string(fileInfo.Name), int64(request.Offset), syscall.O_RDONLY)
-			if err != nil {
-				return err
-			}
-			if err := internal.WriteChunkResponse(readWriter, file, request.Size); err != nil {
-				_ = file.Close()
-				return err
-			}
-			return file.Close()
+	dirStorages := make([]*server.DirStorage, 0, len(dirpaths))
+	layers := make([]server.Storage, 0, len(dirpaths))
+	for _, dirpath := range dirpaths {
+		dirStorage, err := server.NewDirStorage(dirpath, recursive)
+		if err != nil {
+			return nil, nil, err
 		}
+		dirStorages = append(dirStorages, dirStorage)
+		layers = append(layers, dirStorage)
+	}
+	if len(layers) == 1 {
+		return layers[0], dirStorages, nil
 	}
-	return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	storage, err := server.NewOverlayStorage(layers...)
+	return storage, dirStorages, err
 }
 
-func handleConnection(conn net.Conn, files []internal.FileInfo) (rerr error) {
-	defer func() {
-		if err := conn.Close(); err != nil && rerr != nil {
-			rerr = err
-		}
-	}()
-	readWriter := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	requestType, err := internal.ReadRequestType(readWriter)
-	if err != nil {
-		return err
-	}
-	filenames := make([][]byte, 0, len(files))
-	for _, fileInfo := range files {
-		filenames = append(filenames, fileInfo.Name)
-	}
-	if requestType == internal.RequestTypeFilenames {
-		if err := internal.WriteFilenamesResponse(readWriter, filenames); err != nil {
-			return err
-		}
-		if err := readWriter.Flush(); err != nil {
-			return err
-		}
-	} else if requestType == internal.RequestTypeChunk {
-		if err := handleChunkRequest(readWriter, files); err != nil {
-			return err
-		}
-		if err := readWriter.Flush(); err != nil {
-			return err
+func shutdown(s *server.Server, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	var shutdownErr *server.ShutdownError
+	if errors.As(err, &shutdownErr) {
+		log.Printf("Shutdown timeout of %v exceeded, interrupted %d connections:", timeout, len(shutdownErr.Interrupted))
+		for _, interruption := range shutdownErr.Interrupted {
+			log.Printf("  %s: %s", interruption.RemoteAddr, interruption.Activity)
 		}
+		return 1
+	} else if err != nil {
+		log.Println("Shutdown failed: ", err)
+		return 1
 	}
-	return nil
+	log.Println("All connections finished, exiting")
+	return 0
 }
 
 func main() {
-	dirpath := flag.String("dir", ".", "path to files directory")
+	var dirpaths dirsFlag
+	flag.Var(&dirpaths, "dir", "`path` to files directory, repeated to overlay directories with earlier ones taking precedence (default .)")
+	memory := flag.Bool("memory", false, "serve files kept in memory, initially none, instead of files directory")
 	port := flag.Uint("port", 5551, "port number")
+	idleTimeout := flag.Duration("idle-timeout", time.Minute, "time after which an idle connection is closed, 0 to disable")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "time given to receive a request, 0 to disable")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "time given to send a response, 0 to disable")
+	minTransferRate := flag.Uint64("min-transfer-rate", 64<<10, "minimal transfer rate in bytes per second, extends timeouts of chunks and uploads by their size")
+	maxChunkSize := flag.Uint64("max-chunk-size", 16<<20, "maximal size of a sent chunk in bytes, larger requests are answered with shorter chunks, 0 for no limit")
+	maxConnections := flag.Int("max-connections", 1024, "maximal number of open connections, 0 for no limit")
+	maxConnectionsPerIP := flag.Int("max-connections-per-ip", 0, "maximal number of open connections from one IP address, 0 for no limit")
+	bandwidthLimit := flag.Uint64("bandwidth-limit", 0, "maximal rate in bytes per second of sending chunks to all clients, 0 for no limit")
+	clientBandwidthLimit := flag.Uint64("client-bandwidth-limit", 0, "maximal rate in bytes per second of sending chunks to one IP address, 0 for no limit")
+	allowUploads := flag.Bool("allow-uploads", false, "accept files uploaded by clients")
+	recursive := flag.Bool("recursive", false, "serve files in subdirectories of files directory")
+	rescanInterval := flag.Duration("rescan-interval", 5*time.Second, "interval between rescans of files directory, 0 to disable")
+	credentialsPath := flag.String("credentials", "", "path to file with username:password lines, enables authentication")
+	policyPath := flag.String("policy", "", "path to access policy file, enables access control")
+	tlsCert := flag.String("tls-cert", "", "path to PEM encoded TLS certificate, enables TLS")
+	tlsKey := flag.String("tls-key", "", "path to PEM encoded TLS private key")
+	tlsClientCA := flag.String("tls-client-ca", "", "path to PEM encoded CA certificates required to sign client certificates")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time given to active transfers to finish after SIGINT or SIGTERM")
 	flag.Parse()
 	if *port > uint(^uint16(0)) {
 		log.Fatal("Invalid port number specified: ", *port)
 	}
-	files, err := internal.IndexFiles(*dirpath)
+	if *memory && len(dirpaths) != 0 {
+		log.Fatal("Memory storage cannot be combined with files directories")
+	}
+	storage, dirStorages, err := openStorage(dirpaths, *recursive, *memory)
 	if err != nil {
 		log.Fatal("Could not read files directory: ", err)
 	}
-	ln, err := net.Listen("tcp", fmt.Sprint(":", port))
+	if *rescanInterval > 0 && len(dirStorages) != 0 {
+		go func() {
+			for range time.Tick(*rescanInterval) {
+				for _, dirStorage := range dirStorages {
+					if err := dirStorage.Rescan(); err != nil {
+						log.Println("Rescanning files directory failed: ", err)
+					}
+				}
+			}
+		}()
+	}
+	options := server.Options{
+		IdleTimeout:          *idleTimeout,
+		ReadTimeout:          *readTimeout,
+		WriteTimeout:         *writeTimeout,
+		MinTransferRate:      *minTransferRate,
+		MaxChunkSize:         *maxChunkSize,
+		MaxConnections:       *maxConnections,
+		MaxConnectionsPerIP:  *maxConnectionsPerIP,
+		BandwidthLimit:       *bandwidthLimit,
+		ClientBandwidthLimit: *clientBandwidthLimit,
+		AllowUploads:         *allowUploads,
+	}
+	if *credentialsPath != "" {
+		if options.Credentials, err = server.LoadCredentials(*credentialsPath); err != nil {
+			log.Fatal("Could not read credentials: ", err)
+		}
+	}
+	if *policyPath != "" {
+		if options.Policy, err = server.LoadPolicy(*policyPath); err != nil {
+			log.Fatal("Could not read access policy: ", err)
+		}
+		if options.Credentials == nil {
+			log.Println("No credentials given, only access policy rules for all users apply")
+		}
+	}
+	ln, err := net.Listen("tcp", fmt.Sprint(":", *port))
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		conn, err := ln.Accept()
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := internal.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
 		if err != nil {
-			log.Println("Handling connection failed: ", err)
+			log.Fatal("Could not load TLS configuration: ", err)
 		}
-		go func() {
-			if err := handleConnection(conn, files); err != nil {
-				log.Println("Handling connection failed: ", err)
-			}
-		}()
+		log.Println("TLS certificate fingerprint: ", internal.CertificateFingerprint(config.Certificates[0].Certificate[0]))
+		ln = tls.NewListener(ln, config)
+	} else if *tlsClientCA != "" {
+		log.Fatal("Client certificates require TLS certificate and key")
+	}
+	s := server.New(storage, options)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ln)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case received := <-signals:
+		signal.Stop(signals)
+		log.Printf("Received %v, waiting up to %v for active transfers to finish", received, *shutdownTimeout)
 	}
+	os.Exit(shutdown(s, *shutdownTimeout))
 }
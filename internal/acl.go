@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+type Operation uint8
+
+const (
+	OperationList Operation = 1 << iota
+	OperationRead
+	OperationWrite
+)
+
+var operationNames = map[string]Operation{
+	"list":  OperationList,
+	"read":  OperationRead,
+	"write": OperationWrite,
+}
+
+type rule struct {
+	subject    string
+	operations Operation
+	pattern    []string
+}
+
+type Policy struct {
+	groups map[string][]string
+	rules  []rule
+}
+
+func parseOperations(text string) (Operation, error) {
+	var operations Operation = 0
+	for _, name := range strings.Split(text, ",") {
+		operation, ok := operationNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown operation: %s", name)
+		}
+		operations |= operation
+	}
+	return operations, nil
+}
+
+func parseSubject(text string) (string, error) {
+	if text == "*" {
+		return text, nil
+	}
+	fields := strings.SplitN(text, ":", 2)
+	if len(fields) != 2 || fields[1] == "" || (fields[0] != "user" && fields[0] != "group") {
+		return "", fmt.Errorf("invalid subject: %s", text)
+	}
+	return text, nil
+}
+
+func parsePattern(text string) ([]string, error) {
+	components := strings.Split(text, "/")
+	for _, component := range components {
+		if component == "" {
+			return nil, fmt.Errorf("invalid pattern: %s", text)
+		}
+		if _, err := path.Match(component, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %s", text)
+		}
+	}
+	return components, nil
+}
+
+func (policy *Policy) parseLine(fields []string) error {
+	if fields[0] == "group" {
+		if len(fields) != 3 {
+			return errors.New("expected group <name> <user>[,<user>...]")
+		}
+		for _, username := range strings.Split(fields[2], ",") {
+			policy.groups[username] = append(policy.groups[username], fields[1])
+		}
+		return nil
+	}
+	if fields[0] != "allow" || len(fields) < 3 || len(fields) > 4 {
+		return errors.New("expected allow <subject> <operation>[,<operation>...] [pattern]")
+	}
+	subject, err := parseSubject(fields[1])
+	if err != nil {
+		return err
+	}
+	operations, err := parseOperations(fields[2])
+	if err != nil {
+		return err
+	}
+	patternText := "**"
+	if len(fields) == 4 {
+		patternText = fields[3]
+	}
+	pattern, err := parsePattern(patternText)
+	if err != nil {
+		return err
+	}
+	policy.rules = append(policy.rules, rule{subject, operations, pattern})
+	return nil
+}
+
+func LoadPolicy(filename string) (_ *Policy, rerr error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	policy := &Policy{groups: make(map[string][]string)}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := policy.parseLine(fields); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func matchPattern(pattern, components []string) bool {
+	if len(pattern) == 0 {
+		return len(components) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(components); i++ {
+			if matchPattern(pattern[1:], components[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(components) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], components[0]); !matched {
+		return false
+	}
+	return matchPattern(pattern[1:], components[1:])
+}
+
+func (policy *Policy) matchSubject(subject, username string) bool {
+	if subject == "*" {
+		return true
+	}
+	if username == "" {
+		return false
+	}
+	if subject == "user:"+username {
+		return true
+	}
+	for _, group := range policy.groups[username] {
+		if subject == "group:"+group {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *Policy) Allows(username string, operation Operation, filename []byte) bool {
+	if policy == nil {
+		return true
+	}
+	components := strings.Split(string(filename), "/")
+	for _, rule := range policy.rules {
+		if rule.operations&operation != 0 &&
+			policy.matchSubject(rule.subject, username) &&
+			matchPattern(rule.pattern, components) {
+			return true
+		}
+	}
+	return false
+}
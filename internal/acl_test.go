@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func loadTestPolicy(t *testing.T, content string) *Policy {
+	filename := path.Join(t.TempDir(), "policy")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	policy, err := LoadPolicy(filename)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return policy
+}
+
+func TestPolicyAllows(t *testing.T) {
+	policy := loadTestPolicy(t, `
+# comment
+group dev alice,bob
+allow * list
+allow user:alice read,write
+allow group:dev read docs/**
+allow user:carol read *.txt
+`)
+	dataSets := []struct {
+		username  string
+		operation Operation
+		filename  string
+		allowed   bool
+	}{
+		{"", OperationList, "secret/file", true},
+		{"", OperationRead, "file", false},
+		{"alice", OperationRead, "secret/file", true},
+		{"alice", OperationWrite, "file", true},
+		{"bob", OperationRead, "docs/manual.pdf", true},
+		{"bob", OperationRead, "docs/nested/manual.pdf", true},
+		{"bob", OperationRead, "file", false},
+		{"bob", OperationWrite, "docs/manual.pdf", false},
+		{"carol", OperationRead, "notes.txt", true},
+		{"carol", OperationRead, "dir/notes.txt", false},
+		{"carol", OperationRead, "notes.pdf", false},
+		{"dave", OperationRead, "docs/manual.pdf", false},
+	}
+	for _, dataSet := range dataSets {
+		if policy.Allows(dataSet.username, dataSet.operation, []byte(dataSet.filename)) != dataSet.allowed {
+			t.Error("access of", dataSet.username, "to", dataSet.filename, "is not", dataSet.allowed)
+		}
+	}
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	var policy *Policy = nil
+	if !policy.Allows("", OperationWrite, []byte("file")) {
+		t.Fatal("nil policy denied access")
+	}
+}
+
+func TestLoadPolicyOfInvalidFiles(t *testing.T) {
+	contents := []string{
+		"deny * read",
+		"allow * execute",
+		"allow someone read",
+		"allow user: read",
+		"allow * read dir//file",
+		"allow * read [",
+		"group dev",
+	}
+	for _, content := range contents {
+		t.Run(content, func(t *testing.T) {
+			filename := path.Join(t.TempDir(), "policy")
+			if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if _, err := LoadPolicy(filename); err == nil {
+				t.Fatal("expected error not returned")
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Credentials map[string][]byte
+
+func LoadCredentials(filename string) (_ Credentials, rerr error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	credentials := make(Credentials)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", filename, lineNumber)
+		}
+		credentials[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func AuthProof(password, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func (credentials Credentials) Verify(username, challenge, proof []byte) bool {
+	password, ok := credentials[string(username)]
+	expected := AuthProof(password, challenge)
+	return hmac.Equal(expected, proof) && ok
+}
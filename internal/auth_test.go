@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	filename := path.Join(t.TempDir(), "credentials")
+	content := "# comment\n\nalice:secret\nbob:with:colon\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	credentials, err := LoadCredentials(filename)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(credentials) != 2 {
+		t.Fatal("loaded", len(credentials), "users, expected 2")
+	}
+	if string(credentials["alice"]) != "secret" {
+		t.Error("loaded password", string(credentials["alice"]), ", expected secret")
+	}
+	if string(credentials["bob"]) != "with:colon" {
+		t.Error("loaded password", string(credentials["bob"]), ", expected with:colon")
+	}
+}
+
+func TestLoadCredentialsOfInvalidFile(t *testing.T) {
+	filename := path.Join(t.TempDir(), "credentials")
+	if err := ioutil.WriteFile(filename, []byte("alice\n"), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := LoadCredentials(filename); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestCredentialsVerify(t *testing.T) {
+	credentials := Credentials{"alice": []byte("secret")}
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dataSets := []struct {
+		name     string
+		username string
+		password string
+		valid    bool
+	}{
+		{"valid credentials", "alice", "secret", true},
+		{"wrong password", "alice", "wrong", false},
+		{"unknown user", "bob", "secret", false},
+		{"unknown user with empty password", "bob", "", false},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			proof := AuthProof([]byte(dataSet.password), challenge)
+			if credentials.Verify([]byte(dataSet.username), challenge, proof) != dataSet.valid {
+				t.Fatal("verification result is not", dataSet.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func IsChecksumAlgorithm(algorithm uint32) bool {
+	return algorithm == CapabilityChecksumCRC32C || algorithm == CapabilityChecksumSHA256
+}
+
+func NewChecksum(algorithm uint32) (hash.Hash, error) {
+	switch algorithm {
+	case CapabilityChecksumCRC32C:
+		return crc32.New(crc32cTable), nil
+	case CapabilityChecksumSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm: %d", algorithm)
+	}
+}
+
+func ChunkChecksumAlgorithm(capabilities uint32) uint32 {
+	if capabilities&CapabilityChecksumSHA256 != 0 {
+		return CapabilityChecksumSHA256
+	}
+	if capabilities&CapabilityChecksumCRC32C != 0 {
+		return CapabilityChecksumCRC32C
+	}
+	return 0
+}
+
+func ReaderChecksum(reader io.Reader, algorithm uint32) ([]byte, error) {
+	checksum, err := NewChecksum(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(checksum, reader); err != nil {
+		return nil, err
+	}
+	return checksum.Sum(nil), nil
+}
+
+func FileChecksum(filepath string, algorithm uint32) (_ []byte, rerr error) {
+	if _, err := NewChecksum(algorithm); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	return ReaderChecksum(file, algorithm)
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestFileChecksum(t *testing.T) {
+	filepath := path.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(filepath, []byte("123456789"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dataSets := []struct {
+		name      string
+		algorithm uint32
+		digest    string
+	}{
+		{"crc32c", CapabilityChecksumCRC32C, "e3069283"},
+		{"sha256", CapabilityChecksumSHA256, "15e2b0d3c33891ebb0f1ef609ec419420c20e320ce94c65fbc8c3312448eb225"},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			digest, err := FileChecksum(filepath, dataSet.algorithm)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if hex.EncodeToString(digest) != dataSet.digest {
+				t.Fatal("checksum", hex.EncodeToString(digest), ", expected", dataSet.digest)
+			}
+		})
+	}
+	if _, err := FileChecksum(filepath, CapabilityUploads); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestChunkChecksumAlgorithm(t *testing.T) {
+	dataSets := []struct {
+		capabilities uint32
+		algorithm    uint32
+	}{
+		{0, 0},
+		{CapabilityUploads, 0},
+		{CapabilityUploads | CapabilityChecksumCRC32C, CapabilityChecksumCRC32C},
+		{CapabilityChecksumSHA256, CapabilityChecksumSHA256},
+		{CapabilityChecksumCRC32C | CapabilityChecksumSHA256, CapabilityChecksumSHA256},
+	}
+	for _, dataSet := range dataSets {
+		if algorithm := ChunkChecksumAlgorithm(dataSet.capabilities); algorithm != dataSet.algorithm {
+			t.Error("algorithm for", dataSet.capabilities, "is", algorithm, ", expected", dataSet.algorithm)
+		}
+	}
+}
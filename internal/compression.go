@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"path"
+	"strings"
+)
+
+const MaxCompressedChunkSize = 256 << 10
+
+var compressedExtensions = map[string]bool{
+	".7z":   true,
+	".avi":  true,
+	".br":   true,
+	".bz2":  true,
+	".docx": true,
+	".flac": true,
+	".gif":  true,
+	".gz":   true,
+	".jar":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".lz4":  true,
+	".mkv":  true,
+	".mov":  true,
+	".mp3":  true,
+	".mp4":  true,
+	".ogg":  true,
+	".png":  true,
+	".rar":  true,
+	".tgz":  true,
+	".webm": true,
+	".webp": true,
+	".xlsx": true,
+	".xz":   true,
+	".zip":  true,
+	".zst":  true,
+}
+
+func IsCompressedFile(filename []byte) bool {
+	return compressedExtensions[strings.ToLower(path.Ext(string(filename)))]
+}
+
+func CompressChunk(chunk []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func DecompressChunk(reader io.Reader, writer io.Writer, limit uint64) (uint64, error) {
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return 0, err
+	}
+	if limit >= math.MaxInt64 {
+		limit = math.MaxInt64 - 1
+	}
+	size, err := io.Copy(writer, io.LimitReader(gzipReader, int64(limit)+1))
+	if err != nil {
+		return 0, err
+	}
+	if uint64(size) > limit {
+		return 0, protocolErrorf("decompressed chunk exceeds %d bytes", limit)
+	}
+	return uint64(size), gzipReader.Close()
+}
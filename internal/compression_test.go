@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIsCompressedFile(t *testing.T) {
+	dataSets := []struct {
+		filename   string
+		compressed bool
+	}{
+		{"archive.tar.gz", true},
+		{"dir/photo.JPG", true},
+		{"video.mp4", true},
+		{"notes.txt", false},
+		{"dir.zip/notes", false},
+		{"noextension", false},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.filename, func(t *testing.T) {
+			if IsCompressedFile([]byte(dataSet.filename)) != dataSet.compressed {
+				t.Fatal("compression of", dataSet.filename, "is not", dataSet.compressed)
+			}
+		})
+	}
+}
+
+func TestCompressChunk(t *testing.T) {
+	chunk := bytes.Repeat([]byte("compressible "), 1000)
+	compressed, err := CompressChunk(chunk)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(compressed) >= len(chunk) {
+		t.Error("compressed", len(chunk), "bytes into", len(compressed))
+	}
+	decompressed := bytes.NewBuffer(nil)
+	size, err := DecompressChunk(bytes.NewReader(compressed), decompressed, uint64(len(chunk)))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if size != uint64(len(chunk)) || !bytes.Equal(decompressed.Bytes(), chunk) {
+		t.Fatal("decompressed", size, "bytes differing from the chunk")
+	}
+	if _, err := DecompressChunk(bytes.NewReader(compressed), bytes.NewBuffer(nil), uint64(len(chunk)-1)); err == nil {
+		t.Fatal("expected error not returned")
+	}
+	if _, err := DecompressChunk(bytes.NewReader(compressed[:len(compressed)/2]), bytes.NewBuffer(nil), 1<<20); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+const DownloadStateSuffix = ".netstore-state"
+
+type Range struct {
+	Start uint64
+	End   uint64
+}
+
+type DownloadState struct {
+	Size    uint64
+	ModTime int64
+	Ranges  []Range
+}
+
+func DownloadStatePath(filepath string) string {
+	return filepath + DownloadStateSuffix
+}
+
+func LoadDownloadState(filepath string) (DownloadState, error) {
+	encoded, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return DownloadState{}, err
+	}
+	var state DownloadState
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		return DownloadState{}, err
+	}
+	ranges := state.Ranges
+	state.Ranges = nil
+	for _, completed := range ranges {
+		state.Add(completed.Start, completed.End)
+	}
+	return state, nil
+}
+
+func (state *DownloadState) Save(filepath string) error {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(path.Dir(filepath), path.Base(filepath)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encoded); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), filepath)
+}
+
+func (state *DownloadState) Add(start, end uint64) {
+	if end > state.Size {
+		end = state.Size
+	}
+	if start >= end {
+		return
+	}
+	merged := make([]Range, 0, len(state.Ranges)+1)
+	for _, completed := range state.Ranges {
+		if completed.End < start || completed.Start > end {
+			merged = append(merged, completed)
+			continue
+		}
+		if completed.Start < start {
+			start = completed.Start
+		}
+		if completed.End > end {
+			end = completed.End
+		}
+	}
+	merged = append(merged, Range{start, end})
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Start < merged[j].Start
+	})
+	state.Ranges = merged
+}
+
+func (state *DownloadState) Missing() []Range {
+	missing := make([]Range, 0, len(state.Ranges)+1)
+	var offset uint64 = 0
+	for _, completed := range state.Ranges {
+		if completed.Start > offset {
+			missing = append(missing, Range{offset, completed.Start})
+		}
+		offset = completed.End
+	}
+	if offset < state.Size {
+		missing = append(missing, Range{offset, state.Size})
+	}
+	return missing
+}
+
+func (state *DownloadState) Completed() uint64 {
+	var completed uint64 = 0
+	for _, completedRange := range state.Ranges {
+		completed += completedRange.End - completedRange.Start
+	}
+	return completed
+}
+
+func (state *DownloadState) Extent() uint64 {
+	if len(state.Ranges) == 0 {
+		return 0
+	}
+	return state.Ranges[len(state.Ranges)-1].End
+}
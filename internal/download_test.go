@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestDownloadStateAdd(t *testing.T) {
+	dataSets := []struct {
+		name    string
+		added   []Range
+		ranges  []Range
+		missing []Range
+	}{
+		{"empty", nil, nil, []Range{{0, 100}}},
+		{"disjoint", []Range{{50, 60}, {0, 10}}, []Range{{0, 10}, {50, 60}}, []Range{{10, 50}, {60, 100}}},
+		{"adjacent", []Range{{0, 10}, {10, 20}}, []Range{{0, 20}}, []Range{{20, 100}}},
+		{"overlapping", []Range{{5, 30}, {0, 10}, {20, 40}}, []Range{{0, 40}}, []Range{{40, 100}}},
+		{"bridging", []Range{{0, 10}, {20, 30}, {5, 25}}, []Range{{0, 30}}, []Range{{30, 100}}},
+		{"past size", []Range{{90, 200}}, []Range{{90, 100}}, []Range{{0, 90}}},
+		{"empty range", []Range{{10, 10}}, nil, []Range{{0, 100}}},
+		{"complete", []Range{{0, 60}, {60, 100}}, []Range{{0, 100}}, []Range{}},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			state := DownloadState{Size: 100}
+			for _, added := range dataSet.added {
+				state.Add(added.Start, added.End)
+			}
+			if !reflect.DeepEqual(state.Ranges, dataSet.ranges) {
+				t.Error("ranges", state.Ranges, ", expected", dataSet.ranges)
+			}
+			if missing := state.Missing(); !reflect.DeepEqual(missing, dataSet.missing) {
+				t.Error("missing", missing, ", expected", dataSet.missing)
+			}
+		})
+	}
+}
+
+func TestDownloadStateSaveAndLoad(t *testing.T) {
+	statePath := DownloadStatePath(path.Join(t.TempDir(), "file"))
+	state := DownloadState{Size: 100, ModTime: 1600000000}
+	state.Add(0, 10)
+	state.Add(50, 70)
+	if err := state.Save(statePath); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	loaded, err := LoadDownloadState(statePath)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(loaded, state) {
+		t.Fatal("loaded", loaded, ", expected", state)
+	}
+	if loaded.Completed() != 30 {
+		t.Error("completed", loaded.Completed(), "bytes, expected 30")
+	}
+	if loaded.Extent() != 70 {
+		t.Error("extent", loaded.Extent(), ", expected 70")
+	}
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadFilename     = errors.New("no such file or invalid filename")
+	ErrBadOffset       = errors.New("offset beyond the end of file")
+	ErrBadSize         = errors.New("invalid chunk size")
+	ErrReadOnly        = errors.New("uploads are disabled")
+	ErrUnauthenticated = errors.New("authentication required or failed")
+	ErrForbidden       = errors.New("access denied")
+	ErrServerBusy      = errors.New("server busy")
+)
+
+var refusalErrors = map[uint32]error{
+	RefusalCauseBadFilename: ErrBadFilename,
+	RefusalCauseBadOffset:   ErrBadOffset,
+	RefusalCauseBadSize:     ErrBadSize,
+	RefusalCauseReadOnly:    ErrReadOnly,
+	RefusalCauseAuth:        ErrUnauthenticated,
+	RefusalCauseForbidden:   ErrForbidden,
+	RefusalCauseBusy:        ErrServerBusy,
+}
+
+type RefusalError struct {
+	Cause uint32
+}
+
+func (e *RefusalError) Error() string {
+	if err, ok := refusalErrors[e.Cause]; ok {
+		return "server refused: " + err.Error()
+	}
+	return fmt.Sprint("server refused with cause ", e.Cause)
+}
+
+func (e *RefusalError) Unwrap() error {
+	return refusalErrors[e.Cause]
+}
+
+type ProtocolError struct {
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Message
+}
+
+func protocolErrorf(format string, args ...interface{}) error {
+	return &ProtocolError{fmt.Sprintf(format, args...)}
+}
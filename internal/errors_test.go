@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestRefusalError(t *testing.T) {
+	dataSets := []struct {
+		name  string
+		cause uint32
+		err   error
+	}{
+		{"bad filename", RefusalCauseBadFilename, ErrBadFilename},
+		{"bad offset", RefusalCauseBadOffset, ErrBadOffset},
+		{"bad size", RefusalCauseBadSize, ErrBadSize},
+		{"read only", RefusalCauseReadOnly, ErrReadOnly},
+		{"auth", RefusalCauseAuth, ErrUnauthenticated},
+		{"forbidden", RefusalCauseForbidden, ErrForbidden},
+		{"busy", RefusalCauseBusy, ErrServerBusy},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			var err error = &RefusalError{dataSet.cause}
+			if !errors.Is(err, dataSet.err) {
+				t.Fatal("error", err, "does not match", dataSet.err)
+			}
+		})
+	}
+	if errors.Unwrap(&RefusalError{0}) != nil {
+		t.Fatal("unknown cause matched an error")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	buff := make([]byte, 2)
+	binary.BigEndian.PutUint16(buff, RequestTypeFileInfo+1)
+	_, err := ReadRequestType(bytes.NewReader(buff))
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) {
+		t.Fatal("expected error not returned")
+	}
+	binary.BigEndian.PutUint16(buff, ResponseTypeFileInfo+1)
+	_, err = ReadResponseType(bytes.NewReader(buff))
+	if !errors.As(err, &protocolErr) {
+		t.Fatal("expected error not returned")
+	}
+}
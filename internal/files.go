@@ -1,8 +1,14 @@
 package internal
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 const (
@@ -10,13 +16,19 @@ const (
 )
 
 type FileInfo struct {
-	Name []byte
-	Size uint64
+	Name    []byte
+	Size    uint64
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+func NewFileInfo(name []byte, stat os.FileInfo) FileInfo {
+	return FileInfo{name, uint64(stat.Size()), stat.ModTime(), stat.Mode()}
 }
 
 func CreateReceivedFilesDir() error {
 	if _, err := os.Stat(ReceivedFilesDir); os.IsNotExist(err) {
-		return os.Mkdir(ReceivedFilesDir, os.ModeDir)
+		return os.Mkdir(ReceivedFilesDir, 0755)
 	} else {
 		return err
 	}
@@ -36,6 +48,45 @@ func OpenFile(filename string, offset int64, flag int) (*os.File, error) {
 	return file, nil
 }
 
+func ReceivedFilePath(filename string) (string, error) {
+	if !IsValidPath([]byte(filename)) {
+		return "", fmt.Errorf("invalid filename: %q", filename)
+	}
+	if err := CreateReceivedFilesDir(); err != nil {
+		return "", err
+	}
+	received := path.Join(ReceivedFilesDir, filename)
+	if err := os.MkdirAll(path.Dir(received), 0755); err != nil {
+		return "", err
+	}
+	return received, nil
+}
+
+func IndexFileTree(dir string) ([]FileInfo, error) {
+	regFiles := make([]FileInfo, 0, 32)
+	err := filepath.Walk(dir, func(filename string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !file.Mode().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		name := []byte(filepath.ToSlash(relative))
+		if IsValidPath(name) {
+			regFiles = append(regFiles, NewFileInfo(name, file))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return regFiles, nil
+}
+
 func IndexFiles(dir string) ([]FileInfo, error) {
 	allFiles, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -44,8 +95,153 @@ func IndexFiles(dir string) ([]FileInfo, error) {
 	regFiles := make([]FileInfo, 0, len(allFiles))
 	for _, file := range allFiles {
 		if file.Mode().IsRegular() {
-			regFiles = append(regFiles, FileInfo{[]byte(file.Name()), uint64(file.Size())})
+			regFiles = append(regFiles, NewFileInfo([]byte(file.Name()), file))
 		}
 	}
 	return regFiles, nil
 }
+
+func IsValidFilename(filename []byte) bool {
+	return len(filename) != 0 &&
+		string(filename) != "." &&
+		string(filename) != ".." &&
+		bytes.IndexByte(filename, '/') == -1 &&
+		bytes.IndexByte(filename, FilenamesDelimiter) == -1
+}
+
+func IsValidPath(filename []byte) bool {
+	for _, component := range bytes.Split(filename, []byte{'/'}) {
+		if !IsValidFilename(component) {
+			return false
+		}
+	}
+	return true
+}
+
+type FileIndex struct {
+	dir       string
+	recursive bool
+	mutex     sync.RWMutex
+	files     []FileInfo
+}
+
+func NewFileIndex(dir string, recursive bool) (*FileIndex, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	index := &FileIndex{dir: dir, recursive: recursive}
+	if err := index.Rescan(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (index *FileIndex) Dir() string {
+	return index.dir
+}
+
+func (index *FileIndex) IsValidName(filename []byte) bool {
+	if index.recursive {
+		return IsValidPath(filename)
+	}
+	return IsValidFilename(filename)
+}
+
+func (index *FileIndex) Rescan() error {
+	indexFiles := IndexFiles
+	if index.recursive {
+		indexFiles = IndexFileTree
+	}
+	files, err := indexFiles(index.dir)
+	if err != nil {
+		return err
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.files = files
+	return nil
+}
+
+func (index *FileIndex) walkParents(filename []byte, create bool) (bool, error) {
+	parent := index.dir
+	components := bytes.Split(filename, []byte{'/'})
+	for _, component := range components[:len(components)-1] {
+		parent = path.Join(parent, string(component))
+		stat, err := os.Lstat(parent)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(parent, 0755); err != nil {
+				return false, err
+			}
+			continue
+		} else if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if !stat.IsDir() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (index *FileIndex) MakeParents(filename []byte) (bool, error) {
+	if !index.IsValidName(filename) {
+		return false, nil
+	}
+	return index.walkParents(filename, true)
+}
+
+func (index *FileIndex) Refresh(filename []byte) (FileInfo, bool, error) {
+	if !index.IsValidName(filename) {
+		return FileInfo{}, false, nil
+	}
+	if ok, err := index.walkParents(filename, false); err != nil {
+		return FileInfo{}, false, err
+	} else if !ok {
+		index.Remove(filename)
+		return FileInfo{}, false, nil
+	}
+	stat, err := os.Lstat(path.Join(index.dir, string(filename)))
+	if os.IsNotExist(err) || (err == nil && !stat.Mode().IsRegular()) {
+		index.Remove(filename)
+		return FileInfo{}, false, nil
+	} else if err != nil {
+		return FileInfo{}, false, err
+	}
+	fileInfo := NewFileInfo(filename, stat)
+	index.Update(fileInfo)
+	return fileInfo, true, nil
+}
+
+func (index *FileIndex) Files() []FileInfo {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	files := make([]FileInfo, len(index.files))
+	copy(files, index.files)
+	return files
+}
+
+func (index *FileIndex) Update(updated FileInfo) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for i, fileInfo := range index.files {
+		if bytes.Equal(updated.Name, fileInfo.Name) {
+			index.files[i] = updated
+			return
+		}
+	}
+	index.files = append(index.files, updated)
+}
+
+func (index *FileIndex) Remove(filename []byte) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for i, fileInfo := range index.files {
+		if bytes.Equal(filename, fileInfo.Name) {
+			index.files = append(index.files[:i], index.files[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIsValidFilename(t *testing.T) {
+	dataSets := []struct {
+		filename string
+		valid    bool
+	}{
+		{"filename", true},
+		{"  whitespaces  ", true},
+		{".hidden", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"dir/filename", false},
+		{"null\x00byte", false},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.filename, func(t *testing.T) {
+			if IsValidFilename([]byte(dataSet.filename)) != dataSet.valid {
+				t.Fatal("validity of", dataSet.filename, "is not", dataSet.valid)
+			}
+		})
+	}
+}
+
+func TestIsValidPath(t *testing.T) {
+	dataSets := []struct {
+		filename string
+		valid    bool
+	}{
+		{"filename", true},
+		{"dir/filename", true},
+		{"dir/subdir/filename", true},
+		{"", false},
+		{"/filename", false},
+		{"dir/", false},
+		{"dir//filename", false},
+		{"dir/./filename", false},
+		{"../filename", false},
+		{"dir/../../filename", false},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.filename, func(t *testing.T) {
+			if IsValidPath([]byte(dataSet.filename)) != dataSet.valid {
+				t.Fatal("validity of", dataSet.filename, "is not", dataSet.valid)
+			}
+		})
+	}
+}
+
+func TestFileIndexRescan(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "first"), []byte("first"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := os.Mkdir(path.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	index, err := NewFileIndex(dir, false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if files := index.Files(); len(files) != 1 || string(files[0].Name) != "first" {
+		t.Fatal("indexed", files, ", expected only first")
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "second"), []byte("second"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := os.Remove(path.Join(dir, "first")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := index.Rescan(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	files := index.Files()
+	if len(files) != 1 || string(files[0].Name) != "second" {
+		t.Fatal("indexed", files, ", expected only second")
+	}
+	if files[0].Size != uint64(len("second")) {
+		t.Error("indexed size", files[0].Size, ", expected", len("second"))
+	}
+}
+
+func TestFileIndexRefresh(t *testing.T) {
+	dir := t.TempDir()
+	index, err := NewFileIndex(dir, false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	fileInfo, ok, err := index.Refresh([]byte("file"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !ok {
+		t.Fatal("file not found")
+	}
+	if fileInfo.Size != uint64(len("content")) {
+		t.Error("refreshed size", fileInfo.Size, ", expected", len("content"))
+	}
+	if files := index.Files(); len(files) != 1 {
+		t.Error("indexed", len(files), "files, expected 1")
+	}
+	if err := os.Remove(path.Join(dir, "file")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, ok, err := index.Refresh([]byte("file")); err != nil || ok {
+		t.Fatal("removed file found, error:", err)
+	}
+	if files := index.Files(); len(files) != 0 {
+		t.Error("indexed", len(files), "files, expected 0")
+	}
+	if _, ok, err := index.Refresh([]byte("../file")); err != nil || ok {
+		t.Fatal("invalid filename found, error:", err)
+	}
+}
+
+func TestFileIndexOfFileTree(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, "subdir", "nested"), 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	filenames := []string{path.Join(dir, "top"), path.Join(dir, "subdir/nested/deep"), path.Join(outside, "secret")}
+	for _, filename := range filenames {
+		if err := ioutil.WriteFile(filename, []byte("content"), 0644); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if err := os.Symlink(outside, path.Join(dir, "link")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	index, err := NewFileIndex(dir, true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	files := index.Files()
+	if len(files) != 2 || string(files[0].Name) != "subdir/nested/deep" || string(files[1].Name) != "top" {
+		t.Fatal("indexed", files, ", expected subdir/nested/deep and top")
+	}
+	if _, ok, err := index.Refresh([]byte("subdir/nested/deep")); err != nil || !ok {
+		t.Fatal("nested file not found, error:", err)
+	}
+	if _, ok, err := index.Refresh([]byte("link/secret")); err != nil || ok {
+		t.Fatal("file behind symlink found, error:", err)
+	}
+	if ok, err := index.MakeParents([]byte("link/created")); err != nil || ok {
+		t.Fatal("parents created behind symlink, error:", err)
+	}
+	if ok, err := index.MakeParents([]byte("new/dir/created")); err != nil || !ok {
+		t.Fatal("parents not created, error:", err)
+	}
+	if stat, err := os.Lstat(path.Join(dir, "new", "dir")); err != nil || !stat.IsDir() {
+		t.Fatal("parent directory not created, error:", err)
+	}
+}
+
+func TestFileIndexOfSymlinkedRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(path.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "subdir", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	root := path.Join(t.TempDir(), "root")
+	if err := os.Symlink(dir, root); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	index, err := NewFileIndex(root, true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	files := index.Files()
+	if len(files) != 1 || string(files[0].Name) != "subdir/file" {
+		t.Fatal("indexed", files, ", expected subdir/file")
+	}
+	if _, ok, err := index.Refresh([]byte("subdir/file")); err != nil || !ok {
+		t.Fatal("file under symlinked root not found, error:", err)
+	}
+}
@@ -5,19 +5,56 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"time"
 )
 
 const (
-	DefaultPort             uint16 = 5551
-	RequestTypeFilenames    uint16 = 1
-	RequestTypeChunk        uint16 = 2
-	ResponseTypeFilenames   uint16 = 1
-	ResponseTypeRefusal     uint16 = 2
-	ResponseTypeChunk       uint16 = 3
-	FilenamesDelimiter      byte   = 0
-	RefusalCauseBadFilename uint32 = 1
-	RefusalCauseBadOffset   uint32 = 2
-	RefusalCauseBadSize     uint32 = 3
+	DefaultPort              uint16 = 5551
+	RequestTypeFilenames     uint16 = 1
+	RequestTypeChunk         uint16 = 2
+	RequestTypeFileSize      uint16 = 3
+	RequestTypeUpload        uint16 = 4
+	RequestTypeListing       uint16 = 5
+	RequestTypeAuth          uint16 = 6
+	RequestTypeHello         uint16 = 7
+	RequestTypeFileHash      uint16 = 8
+	RequestTypeFileInfo      uint16 = 9
+	ResponseTypeFilenames    uint16 = 1
+	ResponseTypeRefusal      uint16 = 2
+	ResponseTypeChunk        uint16 = 3
+	ResponseTypeFileSize     uint16 = 4
+	ResponseTypeUpload       uint16 = 5
+	ResponseTypeListing      uint16 = 6
+	ResponseTypeChallenge    uint16 = 7
+	ResponseTypeAuth         uint16 = 8
+	ResponseTypeHello        uint16 = 9
+	ResponseTypeNoVersion    uint16 = 10
+	ResponseTypeFileHash     uint16 = 11
+	ResponseTypeFileInfo     uint16 = 12
+	FilenamesDelimiter       byte   = 0
+	RefusalCauseBadFilename  uint32 = 1
+	RefusalCauseBadOffset    uint32 = 2
+	RefusalCauseBadSize      uint32 = 3
+	RefusalCauseReadOnly     uint32 = 4
+	RefusalCauseAuth         uint32 = 5
+	RefusalCauseForbidden    uint32 = 6
+	RefusalCauseBusy         uint32 = 7
+	UploadFlagTruncate       uint16 = 1
+	ListingVersion1          uint16 = 1
+	ListingFlagPermissions   uint16 = 1
+	ProtocolVersion1         uint16 = 1
+	ProtocolVersion2         uint16 = 2
+	LatestProtocolVersion           = ProtocolVersion2
+	CapabilityUploads        uint32 = 1
+	CapabilityCompression    uint32 = 2
+	CapabilityChecksumCRC32C uint32 = 4
+	CapabilityChecksumSHA256 uint32 = 8
+	ChunkEncodingIdentity    uint16 = 0
+	ChunkEncodingGzip        uint16 = 1
+	ChallengeSize                   = 32
+	AuthProofSize                   = 32
 )
 
 func readUint16(reader io.Reader) (uint16, error) {
@@ -28,20 +65,40 @@ func readUint16(reader io.Reader) (uint16, error) {
 	return binary.BigEndian.Uint16(buff), nil
 }
 
+func appendUint32(buff []byte, value uint32) []byte {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, value)
+	return append(buff, encoded...)
+}
+
+func appendUint64(buff []byte, value uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, value)
+	return append(buff, encoded...)
+}
+
 func ReadRequestType(reader io.Reader) (uint16, error) {
 	requestType, err := readUint16(reader)
 	if err != nil {
 		return 0, err
 	}
-	if requestType != RequestTypeFilenames && requestType != RequestTypeChunk {
-		return 0, fmt.Errorf("unknown request type: %d", requestType)
+	if requestType != RequestTypeFilenames &&
+		requestType != RequestTypeChunk &&
+		requestType != RequestTypeFileSize &&
+		requestType != RequestTypeUpload &&
+		requestType != RequestTypeListing &&
+		requestType != RequestTypeAuth &&
+		requestType != RequestTypeHello &&
+		requestType != RequestTypeFileHash &&
+		requestType != RequestTypeFileInfo {
+		return 0, protocolErrorf("unknown request type: %d", requestType)
 	}
 	return requestType, nil
 }
 
 type ChunkRequest struct {
-	Offset   uint32
-	Size     uint32
+	Offset   uint64
+	Size     uint64
 	Filename []byte
 }
 
@@ -57,9 +114,166 @@ func ReadChunkRequest(reader io.Reader) (ChunkRequest, error) {
 	if _, err := io.ReadFull(reader, filename); err != nil {
 		return ChunkRequest{}, err
 	}
+	return ChunkRequest{uint64(offset), uint64(size), filename}, nil
+}
+
+func ReadChunkRequestV2(reader io.Reader) (ChunkRequest, error) {
+	buff := make([]byte, 18)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return ChunkRequest{}, err
+	}
+	offset := binary.BigEndian.Uint64(buff)
+	size := binary.BigEndian.Uint64(buff[8:])
+	filenameLen := binary.BigEndian.Uint16(buff[16:])
+	filename := make([]byte, filenameLen)
+	if _, err := io.ReadFull(reader, filename); err != nil {
+		return ChunkRequest{}, err
+	}
 	return ChunkRequest{offset, size, filename}, nil
 }
 
+type HelloRequest struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	Capabilities uint32
+}
+
+func ReadHelloRequest(reader io.Reader) (HelloRequest, error) {
+	buff := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return HelloRequest{}, err
+	}
+	minVersion := binary.BigEndian.Uint16(buff)
+	maxVersion := binary.BigEndian.Uint16(buff[2:])
+	if minVersion == 0 || minVersion > maxVersion {
+		return HelloRequest{}, protocolErrorf("invalid protocol version range: %d-%d", minVersion, maxVersion)
+	}
+	return HelloRequest{minVersion, maxVersion, binary.BigEndian.Uint32(buff[4:])}, nil
+}
+
+func readLengthPrefixed(reader io.Reader) ([]byte, error) {
+	valueLen, err := readUint16(reader)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, valueLen)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func writeLengthPrefixedRequest(writer io.Writer, requestType uint16, value []byte) error {
+	buff := make([]byte, 4)
+	binary.BigEndian.PutUint16(buff, requestType)
+	binary.BigEndian.PutUint16(buff[2:], uint16(len(value)))
+	buffWriter := bufio.NewWriter(writer)
+	if _, err := buffWriter.Write(buff); err != nil {
+		return err
+	}
+	if _, err := buffWriter.Write(value); err != nil {
+		return err
+	}
+	return buffWriter.Flush()
+}
+
+func ReadFileSizeRequest(reader io.Reader) ([]byte, error) {
+	return readLengthPrefixed(reader)
+}
+
+func ReadFileInfoRequest(reader io.Reader) ([]byte, error) {
+	return readLengthPrefixed(reader)
+}
+
+func ReadAuthRequest(reader io.Reader) ([]byte, error) {
+	return readLengthPrefixed(reader)
+}
+
+func ReadAuthProof(reader io.Reader) ([]byte, error) {
+	proof := make([]byte, AuthProofSize)
+	if _, err := io.ReadFull(reader, proof); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+type UploadRequest struct {
+	Flags    uint16
+	Offset   uint64
+	Size     uint64
+	Filename []byte
+}
+
+func ReadUploadRequest(reader io.Reader) (UploadRequest, error) {
+	buff := make([]byte, 12)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return UploadRequest{}, err
+	}
+	flags := binary.BigEndian.Uint16(buff)
+	offset := binary.BigEndian.Uint32(buff[2:])
+	size := binary.BigEndian.Uint32(buff[6:])
+	filenameLen := binary.BigEndian.Uint16(buff[10:])
+	filename := make([]byte, filenameLen)
+	if _, err := io.ReadFull(reader, filename); err != nil {
+		return UploadRequest{}, err
+	}
+	return UploadRequest{flags, uint64(offset), uint64(size), filename}, nil
+}
+
+func ReadUploadRequestV2(reader io.Reader) (UploadRequest, error) {
+	buff := make([]byte, 20)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return UploadRequest{}, err
+	}
+	flags := binary.BigEndian.Uint16(buff)
+	offset := binary.BigEndian.Uint64(buff[2:])
+	size := binary.BigEndian.Uint64(buff[10:])
+	filenameLen := binary.BigEndian.Uint16(buff[18:])
+	filename := make([]byte, filenameLen)
+	if _, err := io.ReadFull(reader, filename); err != nil {
+		return UploadRequest{}, err
+	}
+	return UploadRequest{flags, offset, size, filename}, nil
+}
+
+type FileHashRequest struct {
+	Algorithm uint32
+	Filename  []byte
+}
+
+func ReadFileHashRequest(reader io.Reader) (FileHashRequest, error) {
+	buff := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return FileHashRequest{}, err
+	}
+	algorithm := binary.BigEndian.Uint32(buff)
+	filename, err := readLengthPrefixed(reader)
+	if err != nil {
+		return FileHashRequest{}, err
+	}
+	if !IsChecksumAlgorithm(algorithm) {
+		return FileHashRequest{}, protocolErrorf("unknown checksum algorithm: %d", algorithm)
+	}
+	return FileHashRequest{algorithm, filename}, nil
+}
+
+type ListingRequest struct {
+	Version uint16
+	Flags   uint16
+}
+
+func ReadListingRequest(reader io.Reader) (ListingRequest, error) {
+	buff := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return ListingRequest{}, err
+	}
+	version := binary.BigEndian.Uint16(buff)
+	if version == 0 {
+		return ListingRequest{}, protocolErrorf("unknown listing version: %d", version)
+	}
+	return ListingRequest{version, binary.BigEndian.Uint16(buff[2:])}, nil
+}
+
 func WriteFilenamesRequest(writer io.Writer) error {
 	buff := make([]byte, 2)
 	binary.BigEndian.PutUint16(buff, RequestTypeFilenames)
@@ -67,31 +281,128 @@ func WriteFilenamesRequest(writer io.Writer) error {
 	return err
 }
 
+func writeRequest(writer io.Writer, header, filename []byte, reader io.Reader, size uint64) error {
+	buffWriter := bufio.NewWriter(writer)
+	if _, err := buffWriter.Write(header); err != nil {
+		return err
+	}
+	if _, err := buffWriter.Write(filename); err != nil {
+		return err
+	}
+	if reader != nil {
+		if _, err := io.CopyN(buffWriter, reader, int64(size)); err != nil {
+			return err
+		}
+	}
+	return buffWriter.Flush()
+}
+
 func WriteChunkRequest(writer io.Writer, offset, size uint32, filename []byte) error {
 	buff := make([]byte, 12)
 	binary.BigEndian.PutUint16(buff, RequestTypeChunk)
 	binary.BigEndian.PutUint32(buff[2:], offset)
 	binary.BigEndian.PutUint32(buff[6:], size)
 	binary.BigEndian.PutUint16(buff[10:], uint16(len(filename)))
-	buffWriter := bufio.NewWriter(writer)
-	if _, err := buffWriter.Write(buff); err != nil {
-		return err
+	return writeRequest(writer, buff, filename, nil, 0)
+}
+
+func WriteChunkRequestV2(writer io.Writer, offset, size uint64, filename []byte) error {
+	buff := make([]byte, 20)
+	binary.BigEndian.PutUint16(buff, RequestTypeChunk)
+	binary.BigEndian.PutUint64(buff[2:], offset)
+	binary.BigEndian.PutUint64(buff[10:], size)
+	binary.BigEndian.PutUint16(buff[18:], uint16(len(filename)))
+	return writeRequest(writer, buff, filename, nil, 0)
+}
+
+func WriteHelloRequest(writer io.Writer, minVersion, maxVersion uint16, capabilities uint32) error {
+	buff := make([]byte, 10)
+	binary.BigEndian.PutUint16(buff, RequestTypeHello)
+	binary.BigEndian.PutUint16(buff[2:], minVersion)
+	binary.BigEndian.PutUint16(buff[4:], maxVersion)
+	binary.BigEndian.PutUint32(buff[6:], capabilities)
+	_, err := writer.Write(buff)
+	return err
+}
+
+func WriteFileSizeRequest(writer io.Writer, filename []byte) error {
+	return writeLengthPrefixedRequest(writer, RequestTypeFileSize, filename)
+}
+
+func WriteFileInfoRequest(writer io.Writer, filename []byte) error {
+	return writeLengthPrefixedRequest(writer, RequestTypeFileInfo, filename)
+}
+
+func WriteAuthRequest(writer io.Writer, username []byte) error {
+	return writeLengthPrefixedRequest(writer, RequestTypeAuth, username)
+}
+
+func WriteAuthProof(writer io.Writer, proof []byte) error {
+	if len(proof) != AuthProofSize {
+		return fmt.Errorf("authentication proof is %d bytes long, expected %d", len(proof), AuthProofSize)
 	}
-	if _, err := buffWriter.Write(filename); err != nil {
-		return err
+	_, err := writer.Write(proof)
+	return err
+}
+
+func WriteUploadRequest(writer io.Writer, flags uint16, offset, size uint32, filename []byte, reader io.Reader) error {
+	buff := make([]byte, 14)
+	binary.BigEndian.PutUint16(buff, RequestTypeUpload)
+	binary.BigEndian.PutUint16(buff[2:], flags)
+	binary.BigEndian.PutUint32(buff[4:], offset)
+	binary.BigEndian.PutUint32(buff[8:], size)
+	binary.BigEndian.PutUint16(buff[12:], uint16(len(filename)))
+	return writeRequest(writer, buff, filename, reader, uint64(size))
+}
+
+func WriteUploadRequestV2(writer io.Writer, flags uint16, offset, size uint64, filename []byte, reader io.Reader) error {
+	if size > math.MaxInt64 {
+		return fmt.Errorf("payload size too big: %d", size)
 	}
-	return buffWriter.Flush()
+	buff := make([]byte, 22)
+	binary.BigEndian.PutUint16(buff, RequestTypeUpload)
+	binary.BigEndian.PutUint16(buff[2:], flags)
+	binary.BigEndian.PutUint64(buff[4:], offset)
+	binary.BigEndian.PutUint64(buff[12:], size)
+	binary.BigEndian.PutUint16(buff[20:], uint16(len(filename)))
+	return writeRequest(writer, buff, filename, reader, size)
+}
+
+func WriteFileHashRequest(writer io.Writer, algorithm uint32, filename []byte) error {
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint16(buff, RequestTypeFileHash)
+	binary.BigEndian.PutUint32(buff[2:], algorithm)
+	binary.BigEndian.PutUint16(buff[6:], uint16(len(filename)))
+	return writeRequest(writer, buff, filename, nil, 0)
+}
+
+func WriteListingRequest(writer io.Writer, version, flags uint16) error {
+	buff := make([]byte, 6)
+	binary.BigEndian.PutUint16(buff, RequestTypeListing)
+	binary.BigEndian.PutUint16(buff[2:], version)
+	binary.BigEndian.PutUint16(buff[4:], flags)
+	_, err := writer.Write(buff)
+	return err
 }
 
 func ReadResponseType(reader io.Reader) (uint16, error) {
 	responseType, err := readUint16(reader)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	if responseType != ResponseTypeFilenames &&
 		responseType != ResponseTypeRefusal &&
-		responseType != ResponseTypeChunk {
-		return 0, fmt.Errorf("unknown request type: %d", responseType)
+		responseType != ResponseTypeChunk &&
+		responseType != ResponseTypeFileSize &&
+		responseType != ResponseTypeUpload &&
+		responseType != ResponseTypeListing &&
+		responseType != ResponseTypeChallenge &&
+		responseType != ResponseTypeAuth &&
+		responseType != ResponseTypeHello &&
+		responseType != ResponseTypeNoVersion &&
+		responseType != ResponseTypeFileHash &&
+		responseType != ResponseTypeFileInfo {
+		return 0, protocolErrorf("unknown response type: %d", responseType)
 	}
 	return responseType, nil
 }
@@ -152,29 +463,63 @@ func ReadRefusal(reader io.Reader) (uint32, error) {
 	refusalCause := binary.BigEndian.Uint32(buff)
 	if refusalCause != RefusalCauseBadFilename &&
 		refusalCause != RefusalCauseBadOffset &&
-		refusalCause != RefusalCauseBadSize {
-		return 0, fmt.Errorf("unknown refusal cause: %d", refusalCause)
+		refusalCause != RefusalCauseBadSize &&
+		refusalCause != RefusalCauseReadOnly &&
+		refusalCause != RefusalCauseAuth &&
+		refusalCause != RefusalCauseForbidden &&
+		refusalCause != RefusalCauseBusy {
+		return 0, protocolErrorf("unknown refusal cause: %d", refusalCause)
 	}
 	return refusalCause, nil
 }
 
-func ReadChunkResponse(reader io.Reader, writer io.Writer) (uint32, error) {
+func ReadChunkResponse(reader io.Reader, writer io.Writer, limit uint32) (uint32, error) {
 	buff := make([]byte, 4)
 	if _, err := io.ReadFull(reader, buff); err != nil {
 		return 0, err
 	}
 	chunkSize := binary.BigEndian.Uint32(buff)
+	if chunkSize > limit {
+		return 0, protocolErrorf("chunk of %d bytes exceeds the requested %d bytes", chunkSize, limit)
+	}
 	if _, err := io.CopyN(writer, reader, int64(chunkSize)); err != nil {
 		return 0, err
 	}
 	return chunkSize, nil
 }
 
-func WriteChunkResponse(writer io.Writer, reader io.Reader, chunkSize uint32) error {
-	buff := make([]byte, 4)
-	binary.BigEndian.PutUint32(buff, chunkSize)
+func ReadChunkResponseV2(reader io.Reader, writer io.Writer, limit uint64) (uint64, error) {
+	buff := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return 0, err
+	}
+	chunkSize := binary.BigEndian.Uint64(buff)
+	if chunkSize > math.MaxInt64 {
+		return 0, protocolErrorf("chunk size too big: %d", chunkSize)
+	}
+	if chunkSize > limit {
+		return 0, protocolErrorf("chunk of %d bytes exceeds the requested %d bytes", chunkSize, limit)
+	}
+	if _, err := io.CopyN(writer, reader, int64(chunkSize)); err != nil {
+		return 0, err
+	}
+	return chunkSize, nil
+}
+
+func ReadChunkEncoding(reader io.Reader) (uint16, error) {
+	encoding, err := readUint16(reader)
+	if err != nil {
+		return 0, err
+	}
+	if encoding != ChunkEncodingIdentity && encoding != ChunkEncodingGzip {
+		return 0, protocolErrorf("unknown chunk encoding: %d", encoding)
+	}
+	return encoding, nil
+}
+
+func writeChunkResponse(writer io.Writer, header []byte, reader io.Reader, chunkSize uint64) error {
 	buffWriter := bufio.NewWriter(writer)
-	if _, err := buffWriter.Write(buff); err != nil {
+	if _, err := buffWriter.Write(header); err != nil {
 		return err
 	}
 	if _, err := io.CopyN(buffWriter, reader, int64(chunkSize)); err != nil {
@@ -183,6 +528,34 @@ func WriteChunkResponse(writer io.Writer, reader io.Reader, chunkSize uint32) er
 	return buffWriter.Flush()
 }
 
+func WriteChunkResponse(writer io.Writer, reader io.Reader, chunkSize uint32) error {
+	buff := make([]byte, 6)
+	binary.BigEndian.PutUint16(buff, ResponseTypeChunk)
+	binary.BigEndian.PutUint32(buff[2:], chunkSize)
+	return writeChunkResponse(writer, buff, reader, uint64(chunkSize))
+}
+
+func WriteEncodedChunkResponse(writer io.Writer, reader io.Reader, chunkSize uint64, encoding uint16) error {
+	if chunkSize > math.MaxInt64 {
+		return fmt.Errorf("chunk size too big: %d", chunkSize)
+	}
+	buff := make([]byte, 12)
+	binary.BigEndian.PutUint16(buff, ResponseTypeChunk)
+	binary.BigEndian.PutUint16(buff[2:], encoding)
+	binary.BigEndian.PutUint64(buff[4:], chunkSize)
+	return writeChunkResponse(writer, buff, reader, chunkSize)
+}
+
+func WriteChunkResponseV2(writer io.Writer, reader io.Reader, chunkSize uint64) error {
+	if chunkSize > math.MaxInt64 {
+		return fmt.Errorf("chunk size too big: %d", chunkSize)
+	}
+	buff := make([]byte, 10)
+	binary.BigEndian.PutUint16(buff, ResponseTypeChunk)
+	binary.BigEndian.PutUint64(buff[2:], chunkSize)
+	return writeChunkResponse(writer, buff, reader, chunkSize)
+}
+
 func WriteRefusal(writer io.Writer, cause uint32) error {
 	buff := make([]byte, 6)
 	binary.BigEndian.PutUint16(buff, ResponseTypeRefusal)
@@ -190,3 +563,205 @@ func WriteRefusal(writer io.Writer, cause uint32) error {
 	_, err := writer.Write(buff)
 	return err
 }
+
+func ReadFileSizeResponse(reader io.Reader) (uint64, error) {
+	buff := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buff), nil
+}
+
+func WriteFileSizeResponse(writer io.Writer, size uint64) error {
+	buff := make([]byte, 10)
+	binary.BigEndian.PutUint16(buff, ResponseTypeFileSize)
+	binary.BigEndian.PutUint64(buff[2:], size)
+	_, err := writer.Write(buff)
+	return err
+}
+
+func ReadFileInfoResponse(reader io.Reader) (FileInfo, error) {
+	buff := make([]byte, 16)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Size:    binary.BigEndian.Uint64(buff),
+		ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(buff[8:]))),
+	}, nil
+}
+
+func WriteFileInfoResponse(writer io.Writer, fileInfo FileInfo) error {
+	buff := make([]byte, 18)
+	binary.BigEndian.PutUint16(buff, ResponseTypeFileInfo)
+	binary.BigEndian.PutUint64(buff[2:], fileInfo.Size)
+	binary.BigEndian.PutUint64(buff[10:], uint64(fileInfo.ModTime.UnixNano()))
+	_, err := writer.Write(buff)
+	return err
+}
+
+func WriteUploadResponse(writer io.Writer) error {
+	buff := make([]byte, 2)
+	binary.BigEndian.PutUint16(buff, ResponseTypeUpload)
+	_, err := writer.Write(buff)
+	return err
+}
+
+type ListingResponse struct {
+	Version uint16
+	Flags   uint16
+	Files   []FileInfo
+}
+
+func ReadListingResponse(reader io.Reader) (ListingResponse, error) {
+	buff := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return ListingResponse{}, err
+	}
+	version := binary.BigEndian.Uint16(buff)
+	if version != ListingVersion1 {
+		return ListingResponse{}, protocolErrorf("unknown listing version: %d", version)
+	}
+	flags := binary.BigEndian.Uint16(buff[2:])
+	entriesCount := binary.BigEndian.Uint32(buff[4:])
+	entrySize := 18
+	if flags&ListingFlagPermissions != 0 {
+		entrySize += 4
+	}
+	files := make([]FileInfo, 0, 32)
+	for i := uint32(0); i < entriesCount; i++ {
+		nameLen, err := readUint16(reader)
+		if err != nil {
+			return ListingResponse{}, err
+		}
+		entry := make([]byte, int(nameLen)+entrySize-2)
+		if _, err := io.ReadFull(reader, entry); err != nil {
+			return ListingResponse{}, err
+		}
+		fileInfo := FileInfo{
+			Name:    entry[:nameLen],
+			Size:    binary.BigEndian.Uint64(entry[nameLen:]),
+			ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(entry[nameLen+8:]))),
+		}
+		if flags&ListingFlagPermissions != 0 {
+			fileInfo.Mode = os.FileMode(binary.BigEndian.Uint32(entry[nameLen+16:])).Perm()
+		}
+		files = append(files, fileInfo)
+	}
+	return ListingResponse{version, flags, files}, nil
+}
+
+func WriteListingResponse(writer io.Writer, version, flags uint16, files []FileInfo) error {
+	if version != ListingVersion1 {
+		return fmt.Errorf("unknown listing version: %d", version)
+	}
+	buff := make([]byte, 10, 32)
+	binary.BigEndian.PutUint16(buff, ResponseTypeListing)
+	binary.BigEndian.PutUint16(buff[2:], version)
+	binary.BigEndian.PutUint16(buff[4:], flags)
+	binary.BigEndian.PutUint32(buff[6:], uint32(len(files)))
+	buffWriter := bufio.NewWriter(writer)
+	if _, err := buffWriter.Write(buff); err != nil {
+		return err
+	}
+	for _, fileInfo := range files {
+		buff = buff[:2]
+		binary.BigEndian.PutUint16(buff, uint16(len(fileInfo.Name)))
+		buff = append(buff, fileInfo.Name...)
+		buff = appendUint64(buff, fileInfo.Size)
+		buff = appendUint64(buff, uint64(fileInfo.ModTime.UnixNano()))
+		if flags&ListingFlagPermissions != 0 {
+			buff = appendUint32(buff, uint32(fileInfo.Mode.Perm()))
+		}
+		if _, err := buffWriter.Write(buff); err != nil {
+			return err
+		}
+	}
+	return buffWriter.Flush()
+}
+
+func ReadChallenge(reader io.Reader) ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := io.ReadFull(reader, challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func WriteChallenge(writer io.Writer, challenge []byte) error {
+	if len(challenge) != ChallengeSize {
+		return fmt.Errorf("challenge is %d bytes long, expected %d", len(challenge), ChallengeSize)
+	}
+	buff := make([]byte, 2, 2+ChallengeSize)
+	binary.BigEndian.PutUint16(buff, ResponseTypeChallenge)
+	buff = append(buff, challenge...)
+	_, err := writer.Write(buff)
+	return err
+}
+
+func WriteAuthResponse(writer io.Writer) error {
+	buff := make([]byte, 2)
+	binary.BigEndian.PutUint16(buff, ResponseTypeAuth)
+	_, err := writer.Write(buff)
+	return err
+}
+
+type HelloResponse struct {
+	Version      uint16
+	Capabilities uint32
+}
+
+func ReadHelloResponse(reader io.Reader) (HelloResponse, error) {
+	buff := make([]byte, 6)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return HelloResponse{}, err
+	}
+	version := binary.BigEndian.Uint16(buff)
+	if version < ProtocolVersion1 || version > LatestProtocolVersion {
+		return HelloResponse{}, protocolErrorf("unknown protocol version: %d", version)
+	}
+	return HelloResponse{version, binary.BigEndian.Uint32(buff[2:])}, nil
+}
+
+func WriteHelloResponse(writer io.Writer, version uint16, capabilities uint32) error {
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint16(buff, ResponseTypeHello)
+	binary.BigEndian.PutUint16(buff[2:], version)
+	binary.BigEndian.PutUint32(buff[4:], capabilities)
+	_, err := writer.Write(buff)
+	return err
+}
+
+type NoVersionResponse struct {
+	MinVersion uint16
+	MaxVersion uint16
+}
+
+func ReadNoVersionResponse(reader io.Reader) (NoVersionResponse, error) {
+	buff := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		return NoVersionResponse{}, err
+	}
+	return NoVersionResponse{binary.BigEndian.Uint16(buff), binary.BigEndian.Uint16(buff[2:])}, nil
+}
+
+func WriteNoVersionResponse(writer io.Writer, minVersion, maxVersion uint16) error {
+	buff := make([]byte, 6)
+	binary.BigEndian.PutUint16(buff, ResponseTypeNoVersion)
+	binary.BigEndian.PutUint16(buff[2:], minVersion)
+	binary.BigEndian.PutUint16(buff[4:], maxVersion)
+	_, err := writer.Write(buff)
+	return err
+}
+
+func ReadFileHashResponse(reader io.Reader) ([]byte, error) {
+	return readLengthPrefixed(reader)
+}
+
+func WriteFileHashResponse(writer io.Writer, digest []byte) error {
+	buff := make([]byte, 4, 4+len(digest))
+	binary.BigEndian.PutUint16(buff, ResponseTypeFileHash)
+	binary.BigEndian.PutUint16(buff[2:], uint16(len(digest)))
+	_, err := writer.Write(append(buff, digest...))
+	return err
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestReadUint16FromValidReader(t *testing.T) {
@@ -55,7 +59,17 @@ func TestReadUint16ReadsExactlyTwoBytes(t *testing.T) {
 }
 
 func TestReadRequestTypeOfValidValues(t *testing.T) {
-	validTypes := []uint16{RequestTypeFilenames, RequestTypeChunk}
+	validTypes := []uint16{
+		RequestTypeFilenames,
+		RequestTypeChunk,
+		RequestTypeFileSize,
+		RequestTypeUpload,
+		RequestTypeListing,
+		RequestTypeAuth,
+		RequestTypeHello,
+		RequestTypeFileHash,
+		RequestTypeFileInfo,
+	}
 	for _, requestType := range validTypes {
 		t.Run(fmt.Sprint("reading type ", requestType), func(t *testing.T) {
 			buff := make([]byte, 2)
@@ -72,7 +86,7 @@ func TestReadRequestTypeOfValidValues(t *testing.T) {
 }
 
 func TestReadRequestTypeOfInvalidValues(t *testing.T) {
-	invalidValues := []uint16{RequestTypeChunk + 1, ^uint16(0)}
+	invalidValues := []uint16{RequestTypeFileInfo + 1, ^uint16(0)}
 	for _, value := range invalidValues {
 		t.Run(fmt.Sprint("reading invalid type ", value), func(t *testing.T) {
 			buff := make([]byte, 2)
@@ -99,6 +113,29 @@ func TestReadRequestTypeReadsExactlyTwoBytes(t *testing.T) {
 	}
 }
 
+func TestReadRequestTypeReturnsEOFBetweenRequests(t *testing.T) {
+	buff := make([]byte, 4)
+	binary.BigEndian.PutUint16(buff, RequestTypeFilenames)
+	binary.BigEndian.PutUint16(buff[2:], RequestTypeFilenames)
+	reader := bytes.NewReader(buff)
+	for i := 0; i < 2; i++ {
+		if _, err := ReadRequestType(reader); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	_, err := ReadRequestType(reader)
+	if err != io.EOF {
+		t.Fatal("read error", err, ", expected", io.EOF)
+	}
+}
+
+func TestReadRequestTypeOfTruncatedRequest(t *testing.T) {
+	_, err := ReadRequestType(bytes.NewReader([]byte{0}))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("read error", err, ", expected", io.ErrUnexpectedEOF)
+	}
+}
+
 func TestReadChunkRequestOfValidRequests(t *testing.T) {
 	dataSets := []struct {
 		offset   uint32
@@ -120,10 +157,10 @@ func TestReadChunkRequestOfValidRequests(t *testing.T) {
 			if err != nil {
 				t.Fatal("unexpected error:", err)
 			}
-			if result.Size != dataSet.size {
+			if result.Size != uint64(dataSet.size) {
 				t.Error("read size", result.Size, ", expected", dataSet.size)
 			}
-			if result.Offset != dataSet.offset {
+			if result.Offset != uint64(dataSet.offset) {
 				t.Error("read offset", result.Offset, ", expected", dataSet.offset)
 			}
 			if string(result.Filename) != dataSet.filename {
@@ -169,7 +206,20 @@ func TestReadChunkRequestReadsOnlyRequest(t *testing.T) {
 }
 
 func TestReadResponseTypeOfValidValues(t *testing.T) {
-	validTypes := []uint16{ResponseTypeFilenames, ResponseTypeRefusal, ResponseTypeChunk}
+	validTypes := []uint16{
+		ResponseTypeFilenames,
+		ResponseTypeRefusal,
+		ResponseTypeChunk,
+		ResponseTypeFileSize,
+		ResponseTypeUpload,
+		ResponseTypeListing,
+		ResponseTypeChallenge,
+		ResponseTypeAuth,
+		ResponseTypeHello,
+		ResponseTypeNoVersion,
+		ResponseTypeFileHash,
+		ResponseTypeFileInfo,
+	}
 	for _, responseType := range validTypes {
 		t.Run(fmt.Sprint("reading type ", responseType), func(t *testing.T) {
 			buff := make([]byte, 2)
@@ -186,7 +236,7 @@ func TestReadResponseTypeOfValidValues(t *testing.T) {
 }
 
 func TestReadResponseTypeOfInvalidValues(t *testing.T) {
-	invalidValues := []uint16{ResponseTypeChunk + 1, ^uint16(0)}
+	invalidValues := []uint16{ResponseTypeFileInfo + 1, ^uint16(0)}
 	for _, value := range invalidValues {
 		buff := make([]byte, 2)
 		binary.BigEndian.PutUint16(buff, value)
@@ -286,7 +336,7 @@ func TestReadFilenamesResponseReadsOnlyResponse(t *testing.T) {
 }
 
 func TestReadRefusalOfValidValues(t *testing.T) {
-	validCauses := []uint32{RefusalCauseBadFilename, RefusalCauseBadOffset, RefusalCauseBadSize}
+	validCauses := []uint32{RefusalCauseBadFilename, RefusalCauseBadOffset, RefusalCauseBadSize, RefusalCauseReadOnly, RefusalCauseAuth, RefusalCauseForbidden, RefusalCauseBusy}
 	for _, cause := range validCauses {
 		t.Run(fmt.Sprint("reading cause ", cause), func(t *testing.T) {
 			buff := make([]byte, 4)
@@ -303,7 +353,7 @@ func TestReadRefusalOfValidValues(t *testing.T) {
 }
 
 func TestReadRefusalOfInvalidValues(t *testing.T) {
-	invalidValues := []uint32{RefusalCauseBadSize + 1, ^uint32(0)}
+	invalidValues := []uint32{RefusalCauseBusy + 1, ^uint32(0)}
 	for _, value := range invalidValues {
 		t.Run(fmt.Sprint("reading invalid value ", value), func(t *testing.T) {
 			buff := make([]byte, 4)
@@ -341,7 +391,7 @@ func TestReadChunkResponseOfValidResponses(t *testing.T) {
 			binary.BigEndian.PutUint32(buff, uint32(len(chunk)))
 			buff = append(buff, chunk...)
 			writer := bytes.NewBuffer(make([]byte, 0, len(chunk)))
-			result, err := ReadChunkResponse(bytes.NewReader(buff), writer)
+			result, err := ReadChunkResponse(bytes.NewReader(buff), writer, uint32(len(chunk)))
 			if err != nil {
 				t.Fatal("unexpected error:", err)
 			}
@@ -368,7 +418,11 @@ func TestReadChunkResponseOfInvalidResponses(t *testing.T) {
 			binary.BigEndian.PutUint32(buff, uint32(len(chunk)))
 			buff = append(buff, chunk...)
 			writer := bytes.NewBuffer(make([]byte, 0, len(chunk)))
-			_, err := ReadChunkResponse(bytes.NewReader(buff[:len(buff)-1]), writer)
+			_, err := ReadChunkResponse(bytes.NewReader(buff[:len(buff)-1]), writer, uint32(len(chunk)))
+			if err == nil {
+				t.Fatal("expected error not returned")
+			}
+			_, err = ReadChunkResponse(bytes.NewReader(buff), writer, uint32(len(chunk))-1)
 			if err == nil {
 				t.Fatal("expected error not returned")
 			}
@@ -420,6 +474,47 @@ func TestWriteChunkRequest(t *testing.T) {
 			if err != nil {
 				t.Fatal("unexpected error:", err)
 			}
+			if request.Offset != uint64(dataSet.offset) {
+				t.Error("read offset", request.Offset, ", expected", dataSet.offset)
+			}
+			if request.Size != uint64(dataSet.size) {
+				t.Error("read size", request.Size, ", expected", dataSet.size)
+			}
+			if string(request.Filename) != dataSet.filename {
+				t.Error("read filename", string(request.Filename), ", expected", dataSet.filename)
+			}
+		})
+	}
+}
+
+func TestWriteChunkRequestV2(t *testing.T) {
+	dataSets := []struct {
+		offset   uint64
+		size     uint64
+		filename string
+	}{
+		{0, 0, "asd"},
+		{1 << 32, 1, "past_4GiB"},
+		{^uint64(0), ^uint64(0), "big_vals"},
+	}
+	for i, dataSet := range dataSets {
+		t.Run(fmt.Sprint("dataset ", i), func(t *testing.T) {
+			buffer := bytes.NewBuffer(make([]byte, 0, 20+len(dataSet.filename)))
+			err := WriteChunkRequestV2(buffer, dataSet.offset, dataSet.size, []byte(dataSet.filename))
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			requestType, err := ReadRequestType(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if requestType != RequestTypeChunk {
+				t.Error("read request type", requestType, ", expected", RequestTypeChunk)
+			}
+			request, err := ReadChunkRequestV2(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
 			if request.Offset != dataSet.offset {
 				t.Error("read offset", request.Offset, ", expected", dataSet.offset)
 			}
@@ -429,10 +524,26 @@ func TestWriteChunkRequest(t *testing.T) {
 			if string(request.Filename) != dataSet.filename {
 				t.Error("read filename", string(request.Filename), ", expected", dataSet.filename)
 			}
+			if buffer.Len() != 0 {
+				t.Error(buffer.Len(), "bytes left unread")
+			}
 		})
 	}
 }
 
+func TestReadChunkRequestV2FromReaderTooShort(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	if err := WriteChunkRequestV2(buffer, 1, 2, []byte("filename")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	buff := buffer.Bytes()[2:]
+	for _, length := range []int{0, 17, len(buff) - 1} {
+		if _, err := ReadChunkRequestV2(bytes.NewReader(buff[:length])); err == nil {
+			t.Error("expected error not returned for", length, "bytes")
+		}
+	}
+}
+
 func TestWriteFilenamesResponse(t *testing.T) {
 	dataSets := [][]string{
 		{},
@@ -476,7 +587,7 @@ func TestWriteFilenamesResponse(t *testing.T) {
 }
 
 func TestWriteRefusal(t *testing.T) {
-	causes := []uint32{RefusalCauseBadFilename, RefusalCauseBadOffset, RefusalCauseBadSize}
+	causes := []uint32{RefusalCauseBadFilename, RefusalCauseBadOffset, RefusalCauseBadSize, RefusalCauseReadOnly, RefusalCauseAuth, RefusalCauseForbidden, RefusalCauseBusy}
 	for _, cause := range causes {
 		t.Run(fmt.Sprint("writing cause ", cause), func(t *testing.T) {
 			buffer := bytes.NewBuffer(make([]byte, 0, 6))
@@ -516,7 +627,14 @@ func TestWriteChunkResponseFull(t *testing.T) {
 			if err != nil {
 				t.Fatal("unexpected error:", err)
 			}
-			received, err := ReadChunkResponse(writer, reader)
+			responseType, err := ReadResponseType(writer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if responseType != ResponseTypeChunk {
+				t.Error("read response type", responseType, ", expected", ResponseTypeChunk)
+			}
+			received, err := ReadChunkResponse(writer, reader, uint32(len(chunk)))
 			if err != nil {
 				t.Fatal("unexpected error:", err)
 			}
@@ -531,6 +649,97 @@ func TestWriteChunkResponseFull(t *testing.T) {
 	}
 }
 
+func TestWriteChunkResponseV2(t *testing.T) {
+	chunk := "chunk"
+	reader := bytes.NewBuffer([]byte(chunk))
+	writer := bytes.NewBuffer(nil)
+	if err := WriteChunkResponseV2(writer, reader, uint64(len(chunk))); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if writer.Len() != 10+len(chunk) {
+		t.Error("written", writer.Len(), "bytes, expected", 10+len(chunk))
+	}
+	responseType, err := ReadResponseType(writer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeChunk {
+		t.Error("read response type", responseType, ", expected", ResponseTypeChunk)
+	}
+	received, err := ReadChunkResponseV2(writer, reader, uint64(len(chunk)))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if received != uint64(len(chunk)) {
+		t.Error("received", received, "bytes, expected", len(chunk))
+	}
+	if string(reader.Bytes()) != chunk {
+		t.Fatal("received", string(reader.Bytes()), ", expected", chunk)
+	}
+}
+
+func TestWriteEncodedChunkResponse(t *testing.T) {
+	chunk := "compressed chunk"
+	buffer := bytes.NewBuffer(nil)
+	if err := WriteEncodedChunkResponse(buffer, bytes.NewReader([]byte(chunk)), uint64(len(chunk)), ChunkEncodingGzip); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeChunk {
+		t.Error("read response type", responseType, ", expected", ResponseTypeChunk)
+	}
+	encoding, err := ReadChunkEncoding(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if encoding != ChunkEncodingGzip {
+		t.Error("read encoding", encoding, ", expected", ChunkEncodingGzip)
+	}
+	received := bytes.NewBuffer(nil)
+	if _, err := ReadChunkResponseV2(buffer, received, uint64(len(chunk))); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if received.String() != chunk {
+		t.Error("received", received.String(), ", expected", chunk)
+	}
+}
+
+func TestReadChunkEncodingOfInvalidValues(t *testing.T) {
+	for _, encoding := range []uint16{ChunkEncodingGzip + 1, ^uint16(0)} {
+		buff := make([]byte, 2)
+		binary.BigEndian.PutUint16(buff, encoding)
+		if _, err := ReadChunkEncoding(bytes.NewReader(buff)); err == nil {
+			t.Error("expected error not returned for encoding", encoding)
+		}
+	}
+}
+
+func TestReadChunkResponseV2OfInvalidResponses(t *testing.T) {
+	dataSets := []struct {
+		name  string
+		size  uint64
+		data  string
+		limit uint64
+	}{
+		{"truncated chunk", 5, "abc", 5},
+		{"size out of range", ^uint64(0), "abc", ^uint64(0)},
+		{"size over limit", 3, "abc", 2},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			buff := make([]byte, 8)
+			binary.BigEndian.PutUint64(buff, dataSet.size)
+			buff = append(buff, dataSet.data...)
+			if _, err := ReadChunkResponseV2(bytes.NewReader(buff), ioutil.Discard, dataSet.limit); err == nil {
+				t.Fatal("expected error not returned")
+			}
+		})
+	}
+}
+
 func TestWriteChunkResponsePartial(t *testing.T) {
 	chunk := "file chunk"
 	reader := bytes.NewReader([]byte(chunk))
@@ -539,8 +748,15 @@ func TestWriteChunkResponsePartial(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
+	responseType, err := ReadResponseType(writer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeChunk {
+		t.Error("read response type", responseType, ", expected", ResponseTypeChunk)
+	}
 	clientWriter := bytes.NewBuffer(make([]byte, 0, len(chunk)))
-	copied, err := ReadChunkResponse(writer, clientWriter)
+	copied, err := ReadChunkResponse(writer, clientWriter, uint32(len(chunk)))
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -551,3 +767,596 @@ func TestWriteChunkResponsePartial(t *testing.T) {
 		t.Error("received", string(clientWriter.Bytes()), ", expected", chunk[:len(chunk)-1])
 	}
 }
+
+func TestWriteFileSizeRequest(t *testing.T) {
+	filenames := []string{"", "filename", "  whitespaces  "}
+	for i, filename := range filenames {
+		t.Run(fmt.Sprint("dataset ", i), func(t *testing.T) {
+			buffer := bytes.NewBuffer(make([]byte, 0, 4+len(filename)))
+			err := WriteFileSizeRequest(buffer, []byte(filename))
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			requestType, err := ReadRequestType(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if requestType != RequestTypeFileSize {
+				t.Error("read request type", requestType, ", expected", RequestTypeFileSize)
+			}
+			result, err := ReadFileSizeRequest(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if string(result) != filename {
+				t.Error("read filename", string(result), ", expected", filename)
+			}
+			if buffer.Len() != 0 {
+				t.Error(buffer.Len(), "bytes not consumed")
+			}
+		})
+	}
+}
+
+func TestReadFileSizeRequestFromReaderTooShort(t *testing.T) {
+	buff := make([]byte, 2)
+	binary.BigEndian.PutUint16(buff, uint16(len("filename")))
+	buff = append(buff, "filename"...)
+	_, err := ReadFileSizeRequest(bytes.NewReader(buff[:len(buff)-1]))
+	if err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestWriteFileSizeResponse(t *testing.T) {
+	sizes := []uint64{0, 1, uint64(^uint32(0)) + 1, ^uint64(0)}
+	for _, size := range sizes {
+		t.Run(fmt.Sprint("writing size ", size), func(t *testing.T) {
+			buffer := bytes.NewBuffer(make([]byte, 0, 10))
+			err := WriteFileSizeResponse(buffer, size)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			responseType, err := ReadResponseType(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if responseType != ResponseTypeFileSize {
+				t.Error("read response type", responseType, ", expected", ResponseTypeFileSize)
+			}
+			result, err := ReadFileSizeResponse(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if result != size {
+				t.Error("read size", result, ", expected", size)
+			}
+		})
+	}
+}
+
+func TestWriteUploadRequest(t *testing.T) {
+	dataSets := []struct {
+		flags    uint16
+		offset   uint32
+		filename string
+		payload  string
+	}{
+		{0, 0, "asd", ""},
+		{UploadFlagTruncate, 0, "example", "payload"},
+		{0, ^uint32(0), "big_offset", "x"},
+	}
+	for i, dataSet := range dataSets {
+		t.Run(fmt.Sprint("dataset ", i), func(t *testing.T) {
+			buffer := bytes.NewBuffer(make([]byte, 0, 14+len(dataSet.filename)+len(dataSet.payload)))
+			err := WriteUploadRequest(
+				buffer,
+				dataSet.flags,
+				dataSet.offset,
+				uint32(len(dataSet.payload)),
+				[]byte(dataSet.filename),
+				bytes.NewReader([]byte(dataSet.payload)),
+			)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			requestType, err := ReadRequestType(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if requestType != RequestTypeUpload {
+				t.Error("read request type", requestType, ", expected", RequestTypeUpload)
+			}
+			request, err := ReadUploadRequest(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if request.Flags != dataSet.flags {
+				t.Error("read flags", request.Flags, ", expected", dataSet.flags)
+			}
+			if request.Offset != uint64(dataSet.offset) {
+				t.Error("read offset", request.Offset, ", expected", dataSet.offset)
+			}
+			if request.Size != uint64(len(dataSet.payload)) {
+				t.Error("read size", request.Size, ", expected", len(dataSet.payload))
+			}
+			if string(request.Filename) != dataSet.filename {
+				t.Error("read filename", string(request.Filename), ", expected", dataSet.filename)
+			}
+			if string(buffer.Bytes()) != dataSet.payload {
+				t.Error("payload", string(buffer.Bytes()), ", expected", dataSet.payload)
+			}
+		})
+	}
+}
+
+func TestWriteUploadRequestV2(t *testing.T) {
+	payload := "payload"
+	buffer := bytes.NewBuffer(nil)
+	var offset uint64 = 5 << 32
+	err := WriteUploadRequestV2(
+		buffer,
+		UploadFlagTruncate,
+		offset,
+		uint64(len(payload)),
+		[]byte("filename"),
+		bytes.NewReader([]byte(payload)),
+	)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	requestType, err := ReadRequestType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if requestType != RequestTypeUpload {
+		t.Error("read request type", requestType, ", expected", RequestTypeUpload)
+	}
+	request, err := ReadUploadRequestV2(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if request.Flags != UploadFlagTruncate {
+		t.Error("read flags", request.Flags, ", expected", UploadFlagTruncate)
+	}
+	if request.Offset != offset {
+		t.Error("read offset", request.Offset, ", expected", offset)
+	}
+	if request.Size != uint64(len(payload)) {
+		t.Error("read size", request.Size, ", expected", len(payload))
+	}
+	if string(request.Filename) != "filename" {
+		t.Error("read filename", string(request.Filename), ", expected filename")
+	}
+	if string(buffer.Bytes()) != payload {
+		t.Error("payload", string(buffer.Bytes()), ", expected", payload)
+	}
+}
+
+func TestWriteUploadRequestV2OfInvalidSize(t *testing.T) {
+	err := WriteUploadRequestV2(ioutil.Discard, 0, 0, ^uint64(0), []byte("filename"), bytes.NewReader(nil))
+	if err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestWriteUploadRequestFromReaderTooShort(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 32))
+	err := WriteUploadRequest(buffer, 0, 0, 8, []byte("filename"), bytes.NewReader([]byte("short")))
+	if err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestReadUploadRequestFromReaderTooShort(t *testing.T) {
+	buff := make([]byte, 12)
+	binary.BigEndian.PutUint16(buff[10:], uint16(len("filename")))
+	buff = append(buff, "filename"...)
+	_, err := ReadUploadRequest(bytes.NewReader(buff[:len(buff)-1]))
+	if err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestWriteUploadResponse(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 2))
+	err := WriteUploadResponse(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeUpload {
+		t.Fatal("read response type", responseType, ", expected", ResponseTypeUpload)
+	}
+}
+
+func TestWriteListingRequest(t *testing.T) {
+	flagSets := []uint16{0, ListingFlagPermissions}
+	for _, flags := range flagSets {
+		t.Run(fmt.Sprint("writing flags ", flags), func(t *testing.T) {
+			buffer := bytes.NewBuffer(make([]byte, 0, 6))
+			err := WriteListingRequest(buffer, ListingVersion1, flags)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			requestType, err := ReadRequestType(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if requestType != RequestTypeListing {
+				t.Error("read request type", requestType, ", expected", RequestTypeListing)
+			}
+			request, err := ReadListingRequest(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if request.Version != ListingVersion1 {
+				t.Error("read version", request.Version, ", expected", ListingVersion1)
+			}
+			if request.Flags != flags {
+				t.Error("read flags", request.Flags, ", expected", flags)
+			}
+		})
+	}
+}
+
+func TestReadListingRequestOfInvalidVersion(t *testing.T) {
+	buff := make([]byte, 4)
+	_, err := ReadListingRequest(bytes.NewReader(buff))
+	if err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestWriteListingResponse(t *testing.T) {
+	files := []FileInfo{
+		{[]byte("first"), 0, time.Unix(0, 0), 0644},
+		{[]byte("second"), ^uint64(0), time.Unix(1600000000, 123456789), 0755 | os.ModeSetuid},
+		{[]byte(""), 13, time.Unix(-1, 0), 0},
+	}
+	flagSets := []uint16{0, ListingFlagPermissions}
+	for _, flags := range flagSets {
+		t.Run(fmt.Sprint("writing flags ", flags), func(t *testing.T) {
+			buffer := bytes.NewBuffer(make([]byte, 0, 128))
+			err := WriteListingResponse(buffer, ListingVersion1, flags, files)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			responseType, err := ReadResponseType(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if responseType != ResponseTypeListing {
+				t.Error("read response type", responseType, ", expected", ResponseTypeListing)
+			}
+			response, err := ReadListingResponse(buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if response.Version != ListingVersion1 {
+				t.Error("read version", response.Version, ", expected", ListingVersion1)
+			}
+			if response.Flags != flags {
+				t.Error("read flags", response.Flags, ", expected", flags)
+			}
+			if len(response.Files) != len(files) {
+				t.Fatal("read", len(response.Files), "files, expected", len(files))
+			}
+			for i, file := range files {
+				result := response.Files[i]
+				if string(result.Name) != string(file.Name) {
+					t.Error("read name", string(result.Name), ", expected", string(file.Name))
+				}
+				if result.Size != file.Size {
+					t.Error("read size", result.Size, ", expected", file.Size)
+				}
+				if !result.ModTime.Equal(file.ModTime) {
+					t.Error("read modification time", result.ModTime, ", expected", file.ModTime)
+				}
+				var mode os.FileMode = 0
+				if flags&ListingFlagPermissions != 0 {
+					mode = file.Mode.Perm()
+				}
+				if result.Mode != mode {
+					t.Error("read mode", result.Mode, ", expected", mode)
+				}
+			}
+			if buffer.Len() != 0 {
+				t.Error(buffer.Len(), "bytes not consumed")
+			}
+		})
+	}
+}
+
+func TestWriteListingResponseOfInvalidVersion(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 10))
+	err := WriteListingResponse(buffer, ListingVersion1+1, 0, nil)
+	if err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestReadListingResponseOfInvalidResponses(t *testing.T) {
+	t.Run("unknown version", func(t *testing.T) {
+		buff := make([]byte, 8)
+		binary.BigEndian.PutUint16(buff, ListingVersion1+1)
+		_, err := ReadListingResponse(bytes.NewReader(buff))
+		if err == nil {
+			t.Fatal("expected error not returned")
+		}
+	})
+
+	t.Run("response too short", func(t *testing.T) {
+		buffer := bytes.NewBuffer(make([]byte, 0, 64))
+		files := []FileInfo{{[]byte("filename"), 1, time.Now(), 0644}}
+		if err := WriteListingResponse(buffer, ListingVersion1, ListingFlagPermissions, files); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		buff := buffer.Bytes()[2:]
+		_, err := ReadListingResponse(bytes.NewReader(buff[:len(buff)-1]))
+		if err == nil {
+			t.Fatal("expected error not returned")
+		}
+	})
+}
+
+func TestAuthExchange(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 128))
+	if err := WriteAuthRequest(buffer, []byte("username")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	requestType, err := ReadRequestType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if requestType != RequestTypeAuth {
+		t.Error("read request type", requestType, ", expected", RequestTypeAuth)
+	}
+	username, err := ReadAuthRequest(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(username) != "username" {
+		t.Error("read username", string(username), ", expected username")
+	}
+	challenge := bytes.Repeat([]byte{7}, ChallengeSize)
+	if err := WriteChallenge(buffer, challenge); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeChallenge {
+		t.Error("read response type", responseType, ", expected", ResponseTypeChallenge)
+	}
+	readChallenge, err := ReadChallenge(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !bytes.Equal(readChallenge, challenge) {
+		t.Error("read challenge", readChallenge, ", expected", challenge)
+	}
+	proof := AuthProof([]byte("password"), challenge)
+	if err := WriteAuthProof(buffer, proof); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	readProof, err := ReadAuthProof(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !bytes.Equal(readProof, proof) {
+		t.Error("read proof", readProof, ", expected", proof)
+	}
+	if err := WriteAuthResponse(buffer); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err = ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeAuth {
+		t.Error("read response type", responseType, ", expected", ResponseTypeAuth)
+	}
+}
+
+func TestWriteChallengeOfInvalidSize(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 2+ChallengeSize))
+	if err := WriteChallenge(buffer, make([]byte, ChallengeSize-1)); err == nil {
+		t.Fatal("expected error not returned")
+	}
+	if err := WriteAuthProof(buffer, make([]byte, AuthProofSize+1)); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestHelloExchange(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	capabilities := CapabilityUploads | CapabilityChecksumSHA256
+	if err := WriteHelloRequest(buffer, ProtocolVersion1, LatestProtocolVersion, capabilities); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	requestType, err := ReadRequestType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if requestType != RequestTypeHello {
+		t.Error("read request type", requestType, ", expected", RequestTypeHello)
+	}
+	request, err := ReadHelloRequest(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expectedRequest := HelloRequest{ProtocolVersion1, LatestProtocolVersion, capabilities}
+	if request != expectedRequest {
+		t.Error("read request", request, ", expected", expectedRequest)
+	}
+	if err := WriteHelloResponse(buffer, ProtocolVersion1, CapabilityUploads); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeHello {
+		t.Error("read response type", responseType, ", expected", ResponseTypeHello)
+	}
+	response, err := ReadHelloResponse(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expectedResponse := HelloResponse{ProtocolVersion1, CapabilityUploads}
+	if response != expectedResponse {
+		t.Error("read response", response, ", expected", expectedResponse)
+	}
+}
+
+func TestReadHelloRequestOfInvalidVersionRanges(t *testing.T) {
+	dataSets := []struct {
+		minVersion uint16
+		maxVersion uint16
+	}{
+		{0, 0},
+		{0, ProtocolVersion1},
+		{ProtocolVersion2, ProtocolVersion1},
+	}
+	for _, dataSet := range dataSets {
+		buff := make([]byte, 8)
+		binary.BigEndian.PutUint16(buff, dataSet.minVersion)
+		binary.BigEndian.PutUint16(buff[2:], dataSet.maxVersion)
+		if _, err := ReadHelloRequest(bytes.NewReader(buff)); err == nil {
+			t.Error("expected error not returned for versions", dataSet.minVersion, dataSet.maxVersion)
+		}
+	}
+}
+
+func TestReadHelloResponseOfInvalidVersions(t *testing.T) {
+	for _, version := range []uint16{0, LatestProtocolVersion + 1} {
+		buff := make([]byte, 6)
+		binary.BigEndian.PutUint16(buff, version)
+		if _, err := ReadHelloResponse(bytes.NewReader(buff)); err == nil {
+			t.Error("expected error not returned for version", version)
+		}
+	}
+}
+
+func TestWriteNoVersionResponse(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	if err := WriteNoVersionResponse(buffer, ProtocolVersion1, LatestProtocolVersion); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeNoVersion {
+		t.Error("read response type", responseType, ", expected", ResponseTypeNoVersion)
+	}
+	response, err := ReadNoVersionResponse(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expected := NoVersionResponse{ProtocolVersion1, LatestProtocolVersion}
+	if response != expected {
+		t.Error("read response", response, ", expected", expected)
+	}
+}
+
+func TestFileHashExchange(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	if err := WriteFileHashRequest(buffer, CapabilityChecksumSHA256, []byte("dir/file")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	requestType, err := ReadRequestType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if requestType != RequestTypeFileHash {
+		t.Error("read request type", requestType, ", expected", RequestTypeFileHash)
+	}
+	request, err := ReadFileHashRequest(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if request.Algorithm != CapabilityChecksumSHA256 {
+		t.Error("read algorithm", request.Algorithm, ", expected", CapabilityChecksumSHA256)
+	}
+	if string(request.Filename) != "dir/file" {
+		t.Error("read filename", string(request.Filename), ", expected dir/file")
+	}
+	digest := bytes.Repeat([]byte{3}, 32)
+	if err := WriteFileHashResponse(buffer, digest); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeFileHash {
+		t.Error("read response type", responseType, ", expected", ResponseTypeFileHash)
+	}
+	result, err := ReadFileHashResponse(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !bytes.Equal(result, digest) {
+		t.Error("read digest", result, ", expected", digest)
+	}
+}
+
+func TestReadFileHashRequestOfInvalidAlgorithms(t *testing.T) {
+	for _, algorithm := range []uint32{0, CapabilityUploads, CapabilityChecksumCRC32C | CapabilityChecksumSHA256} {
+		buffer := bytes.NewBuffer(nil)
+		if err := WriteFileHashRequest(buffer, algorithm, []byte("file")); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := ReadFileHashRequest(bytes.NewReader(buffer.Bytes()[2:])); err == nil {
+			t.Error("expected error not returned for algorithm", algorithm)
+		}
+	}
+}
+
+func TestFileInfoExchange(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	if err := WriteFileInfoRequest(buffer, []byte("dir/file")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	requestType, err := ReadRequestType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if requestType != RequestTypeFileInfo {
+		t.Error("read request type", requestType, ", expected", RequestTypeFileInfo)
+	}
+	filename, err := ReadFileInfoRequest(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(filename) != "dir/file" {
+		t.Error("read filename", string(filename), ", expected dir/file")
+	}
+	fileInfo := FileInfo{Size: 1 << 40, ModTime: time.Unix(1600000000, 123)}
+	if err := WriteFileInfoResponse(buffer, fileInfo); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	responseType, err := ReadResponseType(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType != ResponseTypeFileInfo {
+		t.Error("read response type", responseType, ", expected", ResponseTypeFileInfo)
+	}
+	result, err := ReadFileInfoResponse(buffer)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if result.Size != fileInfo.Size {
+		t.Error("read size", result.Size, ", expected", fileInfo.Size)
+	}
+	if !result.ModTime.Equal(fileInfo.ModTime) {
+		t.Error("read modification time", result.ModTime, ", expected", fileInfo.ModTime)
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+var (
+	ErrIdleTimeout  = errors.New("idle timeout")
+	ErrReadTimeout  = errors.New("read timeout")
+	ErrWriteTimeout = errors.New("write timeout")
+)
+
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TimeoutError(err error) error {
+	if !IsTimeout(err) {
+		return err
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "write" || opErr.Op == "readfrom") {
+		return fmt.Errorf("%w: %v", ErrWriteTimeout, err)
+	}
+	return fmt.Errorf("%w: %v", ErrReadTimeout, err)
+}
+
+func TransferDeadline(timeout time.Duration, minRate, size uint64) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	if minRate > 0 {
+		extra := float64(size) / float64(minRate) * float64(time.Second)
+		if extra >= float64(math.MaxInt64-timeout) {
+			return time.Time{}
+		}
+		timeout += time.Duration(extra)
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimeoutError(t *testing.T) {
+	dataSets := []struct {
+		name string
+		err  error
+		is   error
+	}{
+		{"read", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, ErrReadTimeout},
+		{"write", &net.OpError{Op: "write", Err: os.ErrDeadlineExceeded}, ErrWriteTimeout},
+		{"read from", &net.OpError{Op: "readfrom", Err: os.ErrDeadlineExceeded}, ErrWriteTimeout},
+		{"other", io.EOF, io.EOF},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			if err := TimeoutError(dataSet.err); !errors.Is(err, dataSet.is) {
+				t.Fatal("error", err, "does not match", dataSet.is)
+			}
+		})
+	}
+}
+
+func TestTransferDeadline(t *testing.T) {
+	dataSets := []struct {
+		name     string
+		timeout  time.Duration
+		minRate  uint64
+		size     uint64
+		expected time.Duration
+	}{
+		{"disabled", 0, 1000, 1000, 0},
+		{"unscaled", time.Minute, 0, 1 << 30, time.Minute},
+		{"scaled", time.Minute, 1000, 30000, time.Minute + 30*time.Second},
+		{"overflow", time.Minute, 1, math.MaxUint64, 0},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			now := time.Now()
+			deadline := TransferDeadline(dataSet.timeout, dataSet.minRate, dataSet.size)
+			if dataSet.expected == 0 {
+				if !deadline.IsZero() {
+					t.Fatal("deadline", deadline, "set, expected none")
+				}
+				return
+			}
+			if deadline.Sub(now) < dataSet.expected || deadline.Sub(now) > dataSet.expected+time.Second {
+				t.Fatal("deadline in", deadline.Sub(now), ", expected", dataSet.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type ClientTLSOptions struct {
+	CAFile     string
+	Pin        string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	certs, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certs) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+func CertificateFingerprint(rawCert []byte) string {
+	sum := sha256.Sum256(rawCert)
+	return hex.EncodeToString(sum[:])
+}
+
+func ParseCertificatePin(pin string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("pin is %d bytes long, expected %d", len(decoded), sha256.Size)
+	}
+	return decoded, nil
+}
+
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func ClientTLSConfig(options ClientTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: options.ServerName, MinVersion: tls.VersionTLS12}
+	if options.CAFile != "" {
+		pool, err := loadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if options.Pin != "" {
+		pin, err := ParseCertificatePin(options.Pin)
+		if err != nil {
+			return nil, err
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("server certificate fingerprint %s does not match pin", CertificateFingerprint(rawCerts[0]))
+			}
+			return nil
+		}
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
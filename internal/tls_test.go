@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeCertificate(t *testing.T, dir, name string) (string, string, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	certFile := path.Join(dir, name+".crt")
+	keyFile := path.Join(dir, name+".key")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return certFile, keyFile, rawCert
+}
+
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer ln.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- tls.Server(conn, serverConfig).Handshake()
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	clientErr := tls.Client(conn, clientConfig).Handshake()
+	_ = conn.Close()
+	return <-serverErr, clientErr
+}
+
+func TestParseCertificatePin(t *testing.T) {
+	_, _, rawCert := writeCertificate(t, t.TempDir(), "server")
+	fingerprint := CertificateFingerprint(rawCert)
+	validPins := []string{fingerprint}
+	colonPin := ""
+	for i := 0; i < len(fingerprint); i += 2 {
+		if i != 0 {
+			colonPin += ":"
+		}
+		colonPin += fingerprint[i : i+2]
+	}
+	validPins = append(validPins, colonPin)
+	for _, pin := range validPins {
+		if _, err := ParseCertificatePin(pin); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	invalidPins := []string{"", "zz", fingerprint[2:]}
+	for _, pin := range invalidPins {
+		if _, err := ParseCertificatePin(pin); err == nil {
+			t.Error("expected error not returned for pin", pin)
+		}
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey, rawServerCert := writeCertificate(t, dir, "server")
+	clientCert, clientKey, _ := writeCertificate(t, dir, "client")
+	_, _, rawOtherCert := writeCertificate(t, dir, "other")
+	dataSets := []struct {
+		name         string
+		clientCA     string
+		options      ClientTLSOptions
+		expectFailed bool
+	}{
+		{"verified by CA", "", ClientTLSOptions{CAFile: serverCert, ServerName: "server"}, false},
+		{"wrong server name", "", ClientTLSOptions{CAFile: serverCert, ServerName: "other"}, true},
+		{"unknown CA", "", ClientTLSOptions{ServerName: "server"}, true},
+		{"matching pin", "", ClientTLSOptions{Pin: CertificateFingerprint(rawServerCert)}, false},
+		{"mismatching pin", "", ClientTLSOptions{Pin: CertificateFingerprint(rawOtherCert)}, true},
+		{
+			"client certificate",
+			clientCert,
+			ClientTLSOptions{CAFile: serverCert, ServerName: "server", CertFile: clientCert, KeyFile: clientKey},
+			false,
+		},
+		{"missing client certificate", clientCert, ClientTLSOptions{CAFile: serverCert, ServerName: "server"}, true},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			serverConfig, err := ServerTLSConfig(serverCert, serverKey, dataSet.clientCA)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			clientConfig, err := ClientTLSConfig(dataSet.options)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			serverErr, clientErr := handshake(t, serverConfig, clientConfig)
+			failed := serverErr != nil || clientErr != nil
+			if failed != dataSet.expectFailed {
+				t.Fatal("handshake failed:", failed, ", expected", dataSet.expectFailed, serverErr, clientErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package server
+
+import (
+	"NetStore/internal"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+type session struct {
+	conn          net.Conn
+	remoteAddr    string
+	host          string
+	bucket        *tokenBucket
+	username      string
+	authenticated bool
+	version       uint16
+	capabilities  uint32
+	idle          bool
+	interrupted   bool
+	activity      string
+	writeDeadline time.Time
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		conn:       conn,
+		remoteAddr: conn.RemoteAddr().String(),
+		host:       hostOf(conn.RemoteAddr()),
+		version:    internal.ProtocolVersion1,
+	}
+}
+
+var requestNames = map[uint16]string{
+	internal.RequestTypeFilenames: "filenames",
+	internal.RequestTypeChunk:     "chunk",
+	internal.RequestTypeFileSize:  "file size",
+	internal.RequestTypeUpload:    "upload",
+	internal.RequestTypeListing:   "listing",
+	internal.RequestTypeAuth:      "auth",
+	internal.RequestTypeHello:     "hello",
+	internal.RequestTypeFileHash:  "file hash",
+	internal.RequestTypeFileInfo:  "file info",
+}
+
+func (s *Server) isAuthenticated(session *session) bool {
+	return s.options.Credentials == nil || session.authenticated
+}
+
+func isMissing(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrInvalidName)
+}
+
+func (s *Server) statFile(filename []byte) (FileInfo, bool, error) {
+	fileInfo, err := s.storage.Stat(string(filename))
+	if isMissing(err) {
+		return FileInfo{}, false, nil
+	} else if err != nil {
+		return FileInfo{}, false, err
+	}
+	return fileInfo, true, nil
+}
+
+func (s *Server) listedFiles(session *session) ([]internal.FileInfo, error) {
+	files, err := s.storage.List()
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]internal.FileInfo, 0, len(files))
+	for _, fileInfo := range files {
+		if s.options.Policy.Allows(session.username, internal.OperationList, []byte(fileInfo.Name)) {
+			listed = append(listed, protocolFileInfo(fileInfo))
+		}
+	}
+	return listed, nil
+}
+
+func (s *Server) handleFilenamesRequest(readWriter *bufio.ReadWriter, session *session) error {
+	if !s.isAuthenticated(session) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseAuth)
+	}
+	files, err := s.listedFiles(session)
+	if err != nil {
+		return err
+	}
+	filenames := make([][]byte, 0, len(files))
+	for _, fileInfo := range files {
+		filenames = append(filenames, fileInfo.Name)
+	}
+	return internal.WriteFilenamesResponse(readWriter, filenames)
+}
+
+func readChunkRequest(reader io.Reader, session *session) (internal.ChunkRequest, error) {
+	if session.version >= internal.ProtocolVersion2 {
+		return internal.ReadChunkRequestV2(reader)
+	}
+	return internal.ReadChunkRequest(reader)
+}
+
+func writeCompressedChunk(writer io.Writer, reader io.Reader, size uint64) error {
+	chunkSize := size
+	if chunkSize > internal.MaxCompressedChunkSize {
+		chunkSize = internal.MaxCompressedChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	if _, err := io.ReadFull(reader, chunk); err != nil {
+		return err
+	}
+	compressed, err := internal.CompressChunk(chunk)
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(chunk) {
+		contents := io.MultiReader(bytes.NewReader(chunk), reader)
+		return internal.WriteEncodedChunkResponse(writer, contents, size, internal.ChunkEncodingIdentity)
+	}
+	compressedSize := uint64(len(compressed))
+	return internal.WriteEncodedChunkResponse(writer, bytes.NewReader(compressed), compressedSize, internal.ChunkEncodingGzip)
+}
+
+func writeChunkPayload(writer io.Writer, reader io.Reader, size uint64, session *session, compress bool) error {
+	if session.capabilities&internal.CapabilityCompression != 0 {
+		if compress {
+			return writeCompressedChunk(writer, reader, size)
+		}
+		return internal.WriteEncodedChunkResponse(writer, reader, size, internal.ChunkEncodingIdentity)
+	}
+	if session.version >= internal.ProtocolVersion2 {
+		return internal.WriteChunkResponseV2(writer, reader, size)
+	}
+	return internal.WriteChunkResponse(writer, reader, uint32(size))
+}
+
+func writeChunkResponse(writer io.Writer, reader io.Reader, size uint64, session *session, compress bool) error {
+	algorithm := internal.ChunkChecksumAlgorithm(session.capabilities)
+	if algorithm == 0 {
+		return writeChunkPayload(writer, reader, size, session, compress)
+	}
+	checksum, err := internal.NewChecksum(algorithm)
+	if err != nil {
+		return err
+	}
+	if err := writeChunkPayload(writer, io.TeeReader(reader, checksum), size, session, compress); err != nil {
+		return err
+	}
+	_, err = writer.Write(checksum.Sum(nil))
+	return err
+}
+
+func (s *Server) handleChunkRequest(readWriter *bufio.ReadWriter, session *session) error {
+	request, err := readChunkRequest(readWriter, session)
+	if err != nil {
+		return err
+	}
+	if !s.isAuthenticated(session) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseAuth)
+	}
+	if !s.options.Policy.Allows(session.username, internal.OperationRead, request.Filename) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseForbidden)
+	}
+	if request.Size == 0 || request.Size > math.MaxInt64 {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadSize)
+	}
+	fileInfo, ok, err := s.statFile(request.Filename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	}
+	if request.Offset >= fileInfo.Size {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadOffset)
+	}
+	size := request.Size
+	if available := fileInfo.Size - request.Offset; size > available {
+		size = available
+	}
+	if s.options.MaxChunkSize > 0 && size > s.options.MaxChunkSize {
+		size = s.options.MaxChunkSize
+	}
+	file, err := s.storage.OpenReader(fileInfo.Name, int64(request.Offset))
+	if isMissing(err) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	} else if err != nil {
+		return err
+	}
+	compress := !internal.IsCompressedFile([]byte(fileInfo.Name))
+	if err := s.setDeadline(session, false, s.options.WriteTimeout, size); err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.setActivity(session, "sending %d bytes of %s at offset %d", size, fileInfo.Name, request.Offset)
+	if err := writeChunkResponse(s.rateLimited(readWriter, session), file, size, session, compress); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *Server) handleFileSizeRequest(readWriter *bufio.ReadWriter, session *session) error {
+	filename, err := internal.ReadFileSizeRequest(readWriter)
+	if err != nil {
+		return err
+	}
+	if !s.isAuthenticated(session) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseAuth)
+	}
+	if !s.options.Policy.Allows(session.username, internal.OperationRead, filename) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseForbidden)
+	}
+	fileInfo, ok, err := s.statFile(filename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	}
+	return internal.WriteFileSizeResponse(readWriter, fileInfo.Size)
+}
+
+func (s *Server) handleFileInfoRequest(readWriter *bufio.ReadWriter, session *session) error {
+	filename, err := internal.ReadFileInfoRequest(readWriter)
+	if err != nil {
+		return err
+	}
+	if !s.isAuthenticated(session) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseAuth)
+	}
+	if !s.options.Policy.Allows(session.username, internal.OperationRead, filename) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseForbidden)
+	}
+	fileInfo, ok, err := s.statFile(filename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	}
+	return internal.WriteFileInfoResponse(readWriter, protocolFileInfo(fileInfo))
+}
+
+func (s *Server) handleFileHashRequest(readWriter *bufio.ReadWriter, session *session) error {
+	request, err := internal.ReadFileHashRequest(readWriter)
+	if err != nil {
+		return err
+	}
+	if !s.isAuthenticated(session) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseAuth)
+	}
+	if !s.options.Policy.Allows(session.username, internal.OperationRead, request.Filename) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseForbidden)
+	}
+	fileInfo, ok, err := s.statFile(request.Filename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	}
+	file, err := s.storage.OpenReader(fileInfo.Name, 0)
+	if isMissing(err) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseBadFilename)
+	} else if err != nil {
+		return err
+	}
+	s.setActivity(session, "hashing %s", fileInfo.Name)
+	digest, err := internal.ReaderChecksum(file, request.Algorithm)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := s.setDeadline(session, false, s.options.WriteTimeout, 0); err != nil {
+		return err
+	}
+	return internal.WriteFileHashResponse(readWriter, digest)
+}
+
+func (s *Server) handleListingRequest(readWriter *bufio.ReadWriter, session *session) error {
+	request, err := internal.ReadListingRequest(readWriter)
+	if err != nil {
+		return err
+	}
+	if !s.isAuthenticated(session) {
+		return internal.WriteRefusal(readWriter, internal.RefusalCauseAuth)
+	}
+	version := request.Version
+	if version > internal.ListingVersion1 {
+		version = internal.ListingVersion1
+	}
+	flags := request.Flags & internal.ListingFlagPermissions
+	files, err := s.listedFiles(session)
+	if err != nil {
+		return err
+	}
+	return internal.WriteListingResponse(readWriter, version, flags, files)
+}
+
+func refuseUpload(readWriter io.ReadWriter, request internal.UploadRequest, cause uint32) error {
+	if _, err := io.CopyN(ioutil.Discard, readWriter, int64(request.Size)); err != nil {
+		return err
+	}
+	return internal.WriteRefusal(readWriter, cause)
+}
+
+func readUploadRequest(reader io.Reader, session *session) (internal.UploadRequest, error) {
+	if session.version >= internal.ProtocolVersion2 {
+		return internal.ReadUploadRequestV2(reader)
+	}
+	return internal.ReadUploadRequest(reader)
+}
+
+func (s *Server) handleUploadRequest(readWriter *bufio.ReadWriter, session *session) (rerr error) {
+	request, err := readUploadRequest(readWriter, session)
+	if err != nil {
+		return err
+	}
+	if request.Size > math.MaxInt64 || request.Offset > math.MaxInt64-request.Size {
+		return fmt.Errorf("upload size out of range: %d at offset %d", request.Size, request.Offset)
+	}
+	if !s.isAuthenticated(session) {
+		if err := internal.WriteRefusal(readWriter, internal.RefusalCauseAuth); err != nil {
+			return err
+		}
+		if err := readWriter.Flush(); err != nil {
+			return err
+		}
+		return fmt.Errorf("unauthenticated upload of %q refused", request.Filename)
+	}
+	if err := s.setDeadline(session, true, s.options.ReadTimeout, request.Size); err != nil {
+		return err
+	}
+	if !s.options.AllowUploads {
+		return refuseUpload(readWriter, request, internal.RefusalCauseReadOnly)
+	}
+	if !s.options.Policy.Allows(session.username, internal.OperationWrite, request.Filename) {
+		return refuseUpload(readWriter, request, internal.RefusalCauseForbidden)
+	}
+	var size uint64 = 0
+	if fileInfo, err := s.storage.Stat(string(request.Filename)); errors.Is(err, ErrInvalidName) {
+		return refuseUpload(readWriter, request, internal.RefusalCauseBadFilename)
+	} else if err == nil {
+		size = fileInfo.Size
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if request.Offset > size {
+		return refuseUpload(readWriter, request, internal.RefusalCauseBadOffset)
+	}
+	truncate := request.Flags&internal.UploadFlagTruncate != 0
+	file, err := s.storage.OpenWriter(string(request.Filename), int64(request.Offset), truncate)
+	if errors.Is(err, ErrInvalidName) {
+		return refuseUpload(readWriter, request, internal.RefusalCauseBadFilename)
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	s.setActivity(session, "receiving %d bytes of %s at offset %d", request.Size, request.Filename, request.Offset)
+	if _, err := io.CopyN(file, readWriter, int64(request.Size)); err != nil {
+		return err
+	}
+	return internal.WriteUploadResponse(readWriter)
+}
+
+func (s *Server) handleAuthRequest(readWriter *bufio.ReadWriter, session *session) error {
+	username, err := internal.ReadAuthRequest(readWriter)
+	if err != nil {
+		return err
+	}
+	challenge, err := internal.NewChallenge()
+	if err != nil {
+		return err
+	}
+	if err := internal.WriteChallenge(readWriter, challenge); err != nil {
+		return err
+	}
+	if err := readWriter.Flush(); err != nil {
+		return err
+	}
+	proof, err := internal.ReadAuthProof(readWriter)
+	if err != nil {
+		return err
+	}
+	session.username = ""
+	session.authenticated = false
+	if s.options.Credentials == nil {
+		return internal.WriteAuthResponse(readWriter)
+	}
+	if !s.options.Credentials.Verify(username, challenge, proof) {
+		if err := internal.WriteRefusal(readWriter, internal.RefusalCauseAuth); err != nil {
+			return err
+		}
+		if err := readWriter.Flush(); err != nil {
+			return err
+		}
+		return fmt.Errorf("authentication of %q failed", username)
+	}
+	session.username = string(username)
+	session.authenticated = true
+	return internal.WriteAuthResponse(readWriter)
+}
+
+func (s *Server) capabilities() uint32 {
+	capabilities := internal.CapabilityCompression | internal.CapabilityChecksumCRC32C | internal.CapabilityChecksumSHA256
+	if s.options.AllowUploads {
+		capabilities |= internal.CapabilityUploads
+	}
+	return capabilities
+}
+
+func (s *Server) handleHelloRequest(readWriter *bufio.ReadWriter, session *session) error {
+	request, err := internal.ReadHelloRequest(readWriter)
+	if err != nil {
+		return err
+	}
+	version := request.MaxVersion
+	if version > internal.LatestProtocolVersion {
+		version = internal.LatestProtocolVersion
+	}
+	if version < request.MinVersion || version < internal.ProtocolVersion1 {
+		s.logf(
+			"Protocol versions %d-%d requested by %s are not supported",
+			request.MinVersion,
+			request.MaxVersion,
+			session.remoteAddr,
+		)
+		return internal.WriteNoVersionResponse(readWriter, internal.ProtocolVersion1, internal.LatestProtocolVersion)
+	}
+	session.version = version
+	session.capabilities = request.Capabilities & s.capabilities()
+	if version < internal.ProtocolVersion2 {
+		session.capabilities &^= internal.CapabilityCompression
+	}
+	return internal.WriteHelloResponse(readWriter, session.version, session.capabilities)
+}
+
+var requestHandlers = map[uint16]func(*Server, *bufio.ReadWriter, *session) error{
+	internal.RequestTypeFilenames: (*Server).handleFilenamesRequest,
+	internal.RequestTypeChunk:     (*Server).handleChunkRequest,
+	internal.RequestTypeFileSize:  (*Server).handleFileSizeRequest,
+	internal.RequestTypeUpload:    (*Server).handleUploadRequest,
+	internal.RequestTypeListing:   (*Server).handleListingRequest,
+	internal.RequestTypeAuth:      (*Server).handleAuthRequest,
+	internal.RequestTypeHello:     (*Server).handleHelloRequest,
+	internal.RequestTypeFileHash:  (*Server).handleFileHashRequest,
+	internal.RequestTypeFileInfo:  (*Server).handleFileInfoRequest,
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"NetStore/internal"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitedWriteSize    = 16 << 10
+	busyRefusalTimeout      = 500 * time.Millisecond
+	busyRefusalWriteTimeout = 10 * time.Millisecond
+	busyRefusalDrainSize    = 4 << 10
+	maxBusyRefusals         = 64
+)
+
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (bucket *tokenBucket) reserve(n int) time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.rate {
+		bucket.tokens = bucket.rate
+	}
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+func (bucket *tokenBucket) refillDelay() time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	missing := bucket.rate - bucket.tokens - time.Since(bucket.last).Seconds()*bucket.rate
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / bucket.rate * float64(time.Second))
+}
+
+type rateLimitedWriter struct {
+	writer  io.Writer
+	buckets []*tokenBucket
+	delayed func(time.Duration) error
+}
+
+func (writer *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > rateLimitedWriteSize {
+			n = rateLimitedWriteSize
+		}
+		var delay time.Duration
+		for _, bucket := range writer.buckets {
+			if d := bucket.reserve(n); d > delay {
+				delay = d
+			}
+		}
+		if delay > 0 {
+			if err := writer.delayed(delay); err != nil {
+				return written, err
+			}
+			time.Sleep(delay)
+		}
+		m, err := writer.writer.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+type remoteHost struct {
+	connections int
+	bucket      *tokenBucket
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (s *Server) rateLimited(writer io.Writer, session *session) io.Writer {
+	if s.bucket == nil && session.bucket == nil {
+		return writer
+	}
+	buckets := []*tokenBucket{s.bucket, session.bucket}
+	return &rateLimitedWriter{writer, buckets, func(delay time.Duration) error {
+		return s.extendWriteDeadline(session, delay)
+	}}
+}
+
+func (s *Server) refuseConnection(conn net.Conn) {
+	select {
+	case s.refusals <- struct{}{}:
+	default:
+		if err := conn.SetDeadline(time.Now().Add(busyRefusalWriteTimeout)); err == nil {
+			_ = internal.WriteRefusal(conn, internal.RefusalCauseBusy)
+		}
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		defer func() {
+			<-s.refusals
+		}()
+		refuseBusy(conn)
+	}()
+}
+
+func refuseBusy(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(busyRefusalTimeout)); err != nil {
+		return
+	}
+	if err := internal.WriteRefusal(conn, internal.RefusalCauseBusy); err != nil {
+		return
+	}
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = closer.CloseWrite()
+	}
+	_, _ = io.CopyN(ioutil.Discard, conn, busyRefusalDrainSize)
+}
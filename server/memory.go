@@ -0,0 +1,151 @@
+package server
+
+import (
+	"NetStore/internal"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const memoryFileMode os.FileMode = 0644
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+type MemoryStorage struct {
+	mutex sync.RWMutex
+	files map[string]memoryFile
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]memoryFile)}
+}
+
+func (storage *MemoryStorage) isValidName(name string) bool {
+	if !internal.IsValidPath([]byte(name)) {
+		return false
+	}
+	for parent := name; strings.Contains(parent, "/"); {
+		parent = parent[:strings.LastIndexByte(parent, '/')]
+		if _, ok := storage.files[parent]; ok {
+			return false
+		}
+	}
+	for filename := range storage.files {
+		if strings.HasPrefix(filename, name+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+func (storage *MemoryStorage) WriteFile(name string, data []byte) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if !storage.isValidName(name) {
+		return ErrInvalidName
+	}
+	storage.files[name] = memoryFile{append([]byte(nil), data...), time.Now()}
+	return nil
+}
+
+func (storage *MemoryStorage) Remove(name string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if _, ok := storage.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(storage.files, name)
+	return nil
+}
+
+func (storage *MemoryStorage) List() ([]FileInfo, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	files := make([]FileInfo, 0, len(storage.files))
+	for name, file := range storage.files {
+		files = append(files, FileInfo{name, uint64(len(file.data)), file.modTime, memoryFileMode})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+func (storage *MemoryStorage) Stat(name string) (FileInfo, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	file, ok := storage.files[name]
+	if !ok && !internal.IsValidPath([]byte(name)) {
+		return FileInfo{}, ErrInvalidName
+	} else if !ok {
+		return FileInfo{}, os.ErrNotExist
+	}
+	return FileInfo{name, uint64(len(file.data)), file.modTime, memoryFileMode}, nil
+}
+
+func (storage *MemoryStorage) OpenReader(name string, offset int64) (io.ReadCloser, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	file, ok := storage.files[name]
+	if !ok && !internal.IsValidPath([]byte(name)) {
+		return nil, ErrInvalidName
+	} else if !ok {
+		return nil, os.ErrNotExist
+	}
+	reader := bytes.NewReader(file.data)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+type memoryWriter struct {
+	storage *MemoryStorage
+	name    string
+	data    []byte
+	offset  int
+}
+
+func (writer *memoryWriter) Write(p []byte) (int, error) {
+	if end := writer.offset + len(p); end > len(writer.data) {
+		writer.data = append(writer.data, make([]byte, end-len(writer.data))...)
+	}
+	copy(writer.data[writer.offset:], p)
+	writer.offset += len(p)
+	return len(p), nil
+}
+
+func (writer *memoryWriter) Close() error {
+	writer.storage.mutex.Lock()
+	defer writer.storage.mutex.Unlock()
+	if _, ok := writer.storage.files[writer.name]; !ok && !writer.storage.isValidName(writer.name) {
+		return ErrInvalidName
+	}
+	writer.storage.files[writer.name] = memoryFile{writer.data, time.Now()}
+	return nil
+}
+
+func (storage *MemoryStorage) OpenWriter(name string, offset int64, truncate bool) (io.WriteCloser, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	file, ok := storage.files[name]
+	if !ok && !storage.isValidName(name) {
+		return nil, ErrInvalidName
+	}
+	if offset < 0 {
+		return nil, os.ErrInvalid
+	}
+	data := append([]byte(nil), file.data...)
+	if truncate && int64(len(data)) > offset {
+		data = data[:offset]
+	}
+	return &memoryWriter{storage, name, data, int(offset)}, nil
+}
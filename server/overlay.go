@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+type OverlayStorage struct {
+	layers []Storage
+}
+
+func NewOverlayStorage(layers ...Storage) (*OverlayStorage, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("overlay storage requires at least one layer")
+	}
+	return &OverlayStorage{layers}, nil
+}
+
+func (storage *OverlayStorage) List() ([]FileInfo, error) {
+	listed := make(map[string]bool)
+	files := make([]FileInfo, 0, 32)
+	for _, layer := range storage.layers {
+		layerFiles, err := layer.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range layerFiles {
+			if !listed[fileInfo.Name] {
+				listed[fileInfo.Name] = true
+				files = append(files, fileInfo)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+func (storage *OverlayStorage) Stat(name string) (FileInfo, error) {
+	var firstErr error
+	for _, layer := range storage.layers {
+		fileInfo, err := layer.Stat(name)
+		if !isMissing(err) {
+			return fileInfo, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return FileInfo{}, firstErr
+}
+
+func (storage *OverlayStorage) OpenReader(name string, offset int64) (io.ReadCloser, error) {
+	var firstErr error
+	for _, layer := range storage.layers {
+		reader, err := layer.OpenReader(name, offset)
+		if !isMissing(err) {
+			return reader, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (storage *OverlayStorage) copyUp(name string) (rerr error) {
+	var reader io.ReadCloser
+	for _, layer := range storage.layers[1:] {
+		var err error
+		if reader, err = layer.OpenReader(name, 0); err == nil {
+			break
+		} else if !isMissing(err) {
+			return err
+		}
+	}
+	if reader == nil {
+		return nil
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	writer, err := storage.layers[0].OpenWriter(name, 0, true)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (storage *OverlayStorage) OpenWriter(name string, offset int64, truncate bool) (io.WriteCloser, error) {
+	upper := storage.layers[0]
+	if _, err := upper.Stat(name); errors.Is(err, os.ErrNotExist) && (offset > 0 || !truncate) {
+		if err := storage.copyUp(name); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return upper.OpenWriter(name, offset, truncate)
+}
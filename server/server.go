@@ -0,0 +1,348 @@
+package server
+
+import (
+	"NetStore/internal"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const shutdownPollInterval = 50 * time.Millisecond
+
+var ErrServerClosed = errors.New("server closed")
+
+type Credentials = internal.Credentials
+
+type Policy = internal.Policy
+
+func LoadCredentials(filename string) (Credentials, error) {
+	return internal.LoadCredentials(filename)
+}
+
+func LoadPolicy(filename string) (*Policy, error) {
+	return internal.LoadPolicy(filename)
+}
+
+type Options struct {
+	IdleTimeout          time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	MinTransferRate      uint64
+	MaxChunkSize         uint64
+	MaxConnections       int
+	MaxConnectionsPerIP  int
+	BandwidthLimit       uint64
+	ClientBandwidthLimit uint64
+	AllowUploads         bool
+	Credentials          Credentials
+	Policy               *Policy
+	ErrorLog             *log.Logger
+}
+
+type Server struct {
+	storage      Storage
+	options      Options
+	bucket       *tokenBucket
+	mutex        sync.Mutex
+	listeners    map[net.Listener]struct{}
+	connections  map[net.Conn]*session
+	hosts        map[string]*remoteHost
+	refusals     chan struct{}
+	shuttingDown bool
+}
+
+type Interruption struct {
+	RemoteAddr string
+	Activity   string
+}
+
+type ShutdownError struct {
+	Err         error
+	Interrupted []Interruption
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("%v, %d connections interrupted", e.Err, len(e.Interrupted))
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+func New(storage Storage, options Options) *Server {
+	return &Server{
+		storage:     storage,
+		options:     options,
+		bucket:      newTokenBucket(options.BandwidthLimit),
+		listeners:   make(map[net.Listener]struct{}),
+		connections: make(map[net.Conn]*session),
+		hosts:       make(map[string]*remoteHost),
+		refusals:    make(chan struct{}, maxBusyRefusals),
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.options.ErrorLog != nil {
+		s.options.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *Server) addListener(ln net.Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(ln net.Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.listeners, ln)
+}
+
+func (s *Server) addConnection(conn net.Conn, session *session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return ErrServerClosed
+	}
+	if s.options.MaxConnections > 0 && len(s.connections) >= s.options.MaxConnections {
+		return fmt.Errorf("%w, %d connections open", internal.ErrServerBusy, len(s.connections))
+	}
+	host, ok := s.hosts[session.host]
+	if !ok {
+		host = &remoteHost{bucket: newTokenBucket(s.options.ClientBandwidthLimit)}
+	}
+	if s.options.MaxConnectionsPerIP > 0 && host.connections >= s.options.MaxConnectionsPerIP {
+		return fmt.Errorf("%w, %d connections open from %s", internal.ErrServerBusy, host.connections, session.host)
+	}
+	host.connections++
+	s.hosts[session.host] = host
+	session.bucket = host.bucket
+	s.connections[conn] = session
+	return nil
+}
+
+func (s *Server) removeConnection(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session := s.connections[conn]
+	host := s.hosts[session.host]
+	host.connections--
+	if host.connections == 0 {
+		s.expireHost(session.host, host)
+	}
+	delete(s.connections, conn)
+	return session.interrupted
+}
+
+func (s *Server) expireHost(name string, host *remoteHost) {
+	if s.hosts[name] != host || host.connections > 0 {
+		return
+	}
+	delay := host.bucket.refillDelay()
+	if delay <= 0 {
+		delete(s.hosts, name)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.expireHost(name, host)
+	})
+}
+
+func (s *Server) setIdle(session *session, idle bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if idle && s.shuttingDown {
+		return false
+	}
+	session.idle = idle
+	session.activity = ""
+	return true
+}
+
+func (s *Server) setDeadline(session *session, read bool, timeout time.Duration, size uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	deadline := internal.TransferDeadline(timeout, s.options.MinTransferRate, size)
+	if session.interrupted || (session.idle && s.shuttingDown) {
+		deadline = time.Now()
+	}
+	if read {
+		return session.conn.SetReadDeadline(deadline)
+	}
+	session.writeDeadline = deadline
+	return session.conn.SetWriteDeadline(deadline)
+}
+
+func (s *Server) extendWriteDeadline(session *session, delay time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session.interrupted || session.writeDeadline.IsZero() {
+		return nil
+	}
+	session.writeDeadline = session.writeDeadline.Add(delay)
+	return session.conn.SetWriteDeadline(session.writeDeadline)
+}
+
+func (s *Server) setActivity(session *session, format string, args ...interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session.activity = fmt.Sprintf(format, args...)
+}
+
+func isTemporary(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Temporary()
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.addListener(ln) {
+		return ErrServerClosed
+	}
+	defer s.removeListener(ln)
+	for {
+		conn, err := ln.Accept()
+		if err != nil && s.isShuttingDown() {
+			return ErrServerClosed
+		} else if err != nil && isTemporary(err) {
+			s.logf("Accepting connection failed: %v", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		session := newSession(conn)
+		if err := s.addConnection(conn, session); err == ErrServerClosed {
+			_ = conn.Close()
+			return err
+		} else if err != nil {
+			s.logf("Refused connection from %s: %v", session.remoteAddr, err)
+			s.refuseConnection(conn)
+			continue
+		}
+		go func() {
+			err := s.handleConnection(conn, session)
+			interrupted := s.removeConnection(conn)
+			if errors.Is(err, internal.ErrIdleTimeout) {
+				s.logf("Closed connection from %s: %v", session.remoteAddr, err)
+			} else if err != nil && !interrupted {
+				s.logf("Handling connection from %s failed: %v", session.remoteAddr, err)
+			}
+		}()
+	}
+}
+
+func (s *Server) closeListeners() error {
+	var rerr error
+	for ln := range s.listeners {
+		if err := ln.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+		delete(s.listeners, ln)
+	}
+	return rerr
+}
+
+func (s *Server) closeIdleConnections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn, session := range s.connections {
+		if session.idle {
+			_ = conn.SetDeadline(time.Now())
+		}
+	}
+	return len(s.connections)
+}
+
+func (s *Server) closeConnections() []Interruption {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	interrupted := make([]Interruption, 0, len(s.connections))
+	for conn, session := range s.connections {
+		_ = conn.SetDeadline(time.Now())
+		if !session.idle {
+			session.interrupted = true
+			interrupted = append(interrupted, Interruption{session.remoteAddr, session.activity})
+		}
+	}
+	return interrupted
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	err := s.closeListeners()
+	s.mutex.Unlock()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConnections() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return &ShutdownError{ctx.Err(), s.closeConnections()}
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn, session *session) (rerr error) {
+	defer func() {
+		if err := conn.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	readWriter := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		if !s.setIdle(session, readWriter.Reader.Buffered() == 0) {
+			return nil
+		}
+		if err := s.setDeadline(session, true, s.options.IdleTimeout, 0); err != nil {
+			return err
+		}
+		requestType, err := internal.ReadRequestType(readWriter)
+		if err == io.EOF || (internal.IsTimeout(err) && s.isShuttingDown()) {
+			return nil
+		} else if internal.IsTimeout(err) {
+			return fmt.Errorf("%w after %v", internal.ErrIdleTimeout, s.options.IdleTimeout)
+		} else if err != nil {
+			return err
+		}
+		s.setIdle(session, false)
+		if err := s.setDeadline(session, true, s.options.ReadTimeout, 0); err != nil {
+			return err
+		}
+		if err := s.setDeadline(session, false, s.options.WriteTimeout, 0); err != nil {
+			return err
+		}
+		if handler, ok := requestHandlers[requestType]; ok {
+			s.setActivity(session, "%s request", requestNames[requestType])
+			if err := handler(s, readWriter, session); err != nil {
+				return internal.TimeoutError(err)
+			}
+		}
+		if err := readWriter.Flush(); err != nil {
+			return internal.TimeoutError(err)
+		}
+	}
+}
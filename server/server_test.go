@@ -0,0 +1,974 @@
+package server
+
+import (
+	"NetStore/client"
+	"NetStore/internal"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, storage Storage, options Options) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := New(storage, options)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if err := <-served; err != ErrServerClosed {
+			t.Error("unexpected error:", err)
+		}
+	})
+	return s, ln.Addr().String()
+}
+
+func TestServerDirStorage(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage, err := NewDirStorage(dir, false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{AllowUploads: true})
+	netStore := client.New(address, client.Options{})
+	defer netStore.Close()
+	ctx := context.Background()
+	files, err := netStore.List(ctx)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(files) != 1 || files[0].Name != "file" || files[0].Size != 7 {
+		t.Fatal("listed", files, ", expected file of size 7")
+	}
+	buff := make([]byte, 4)
+	if _, err := netStore.ReadAt(ctx, "file", 3, buff); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(buff) != "tent" {
+		t.Fatal("read", string(buff), ", expected tent")
+	}
+	if _, err := netStore.ReadAt(ctx, "missing", 0, buff); !errors.Is(err, client.ErrBadFilename) {
+		t.Fatal("expected error not returned")
+	}
+	uploaded := path.Join(t.TempDir(), "uploaded")
+	if err := ioutil.WriteFile(uploaded, []byte("uploaded content"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := netStore.Upload(ctx, uploaded, "copy"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, "copy"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(content) != "uploaded content" {
+		t.Fatal("uploaded", string(content), ", expected uploaded content")
+	}
+	if _, err := netStore.Stat(ctx, "copy"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, address := startServer(t, NewMemoryStorage(), Options{})
+	netStore := client.New(address, client.Options{})
+	defer netStore.Close()
+	if _, err := netStore.Filenames(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Fatal("expected error not returned")
+	}
+	if err := s.Serve(nil); err != ErrServerClosed {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func hasActivity(s *Server, activity string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, session := range s.connections {
+		if session.activity == activity {
+			return true
+		}
+	}
+	return false
+}
+
+func connectionCount(s *Server) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.connections)
+}
+
+func TestServerShutdownInterrupts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := New(NewMemoryStorage(), Options{AllowUploads: true})
+	go s.Serve(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer conn.Close()
+	if err := internal.WriteUploadRequest(conn, internal.UploadFlagTruncate, 0, 100, []byte("file"), nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expected := "receiving 100 bytes of file at offset 0"
+	for !hasActivity(s, expected) {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected error not returned")
+	}
+	if len(shutdownErr.Interrupted) != 1 {
+		t.Fatal("interrupted", len(shutdownErr.Interrupted), "connections, expected 1")
+	}
+	if shutdownErr.Interrupted[0].Activity != expected {
+		t.Fatal("interrupted activity", shutdownErr.Interrupted[0].Activity, ", expected", expected)
+	}
+}
+
+func TestServerConnectionLimits(t *testing.T) {
+	dataSets := []struct {
+		name    string
+		options Options
+	}{
+		{"max connections", Options{MaxConnections: 1}},
+		{"max connections per ip", Options{MaxConnectionsPerIP: 1}},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			_, address := startServer(t, NewMemoryStorage(), dataSet.options)
+			ctx := context.Background()
+			first := client.New(address, client.Options{})
+			if _, err := first.Filenames(ctx); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			second := client.New(address, client.Options{})
+			defer second.Close()
+			if _, err := second.Filenames(ctx); !errors.Is(err, client.ErrServerBusy) {
+				t.Fatal("expected error not returned")
+			}
+			if err := first.Close(); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			deadline := time.Now().Add(time.Second)
+			for {
+				_, err := second.Filenames(ctx)
+				if err == nil {
+					break
+				} else if !errors.Is(err, client.ErrServerBusy) || time.Now().After(deadline) {
+					t.Fatal("unexpected error:", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestServerBandwidthLimit(t *testing.T) {
+	dataSets := []struct {
+		name    string
+		options Options
+	}{
+		{"global", Options{BandwidthLimit: 100 << 10}},
+		{"per client", Options{ClientBandwidthLimit: 100 << 10}},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			if err := storage.WriteFile("file", make([]byte, 150<<10)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			_, address := startServer(t, storage, dataSet.options)
+			netStore := client.New(address, client.Options{DisableCompression: true, ChunkSize: 16 << 10})
+			defer netStore.Close()
+			start := time.Now()
+			if _, err := netStore.ReadAt(context.Background(), "file", 0, make([]byte, 150<<10)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+				t.Fatal("transferred in", elapsed, ", expected at least 400ms")
+			}
+		})
+	}
+}
+
+func TestServerChunkSize(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", []byte("0123456789")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{MaxChunkSize: 4})
+	netStore := client.New(address, client.Options{})
+	defer netStore.Close()
+	dataSets := []struct {
+		name     string
+		offset   uint64
+		size     uint64
+		expected string
+	}{
+		{"within max chunk size", 1, 3, "123"},
+		{"beyond max chunk size", 1, 6, "123456"},
+		{"beyond end of file", 2, 100, "23456789"},
+		{"last byte", 9, 4, "9"},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			buffer := bytes.NewBuffer(nil)
+			received, err := netStore.ReadChunk(context.Background(), "file", dataSet.offset, dataSet.size, buffer)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if received != uint64(len(dataSet.expected)) || buffer.String() != dataSet.expected {
+				t.Fatal("received", received, "bytes", buffer.String(), ", expected", dataSet.expected)
+			}
+		})
+	}
+	if _, err := netStore.ReadChunk(context.Background(), "file", 10, 1, ioutil.Discard); !errors.Is(err, client.ErrBadOffset) {
+		t.Fatal("expected error not returned")
+	}
+}
+
+type recordingStorage struct {
+	Storage
+	mutex   sync.Mutex
+	offsets []int64
+}
+
+func (storage *recordingStorage) OpenReader(name string, offset int64) (io.ReadCloser, error) {
+	storage.mutex.Lock()
+	storage.offsets = append(storage.offsets, offset)
+	storage.mutex.Unlock()
+	return storage.Storage.OpenReader(name, offset)
+}
+
+func (storage *recordingStorage) reset() []int64 {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	offsets := storage.offsets
+	storage.offsets = nil
+	return offsets
+}
+
+func TestClientChunkSize(t *testing.T) {
+	memory := NewMemoryStorage()
+	if err := memory.WriteFile("file", []byte("0123456789")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage := &recordingStorage{Storage: memory}
+	_, address := startServer(t, storage, Options{})
+	netStore := client.New(address, client.Options{ChunkSize: 4})
+	defer netStore.Close()
+	dataSets := []struct {
+		name string
+		read func() ([]byte, error)
+	}{
+		{"read chunk", func() ([]byte, error) {
+			buffer := bytes.NewBuffer(nil)
+			_, err := netStore.ReadChunk(context.Background(), "file", 0, 10, buffer)
+			return buffer.Bytes(), err
+		}},
+		{"read at", func() ([]byte, error) {
+			buff := make([]byte, 10)
+			n, err := netStore.ReadAt(context.Background(), "file", 0, buff)
+			return buff[:n], err
+		}},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			storage.reset()
+			received, err := dataSet.read()
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if string(received) != "0123456789" {
+				t.Fatal("received", string(received), ", expected 0123456789")
+			}
+			if offsets := storage.reset(); len(offsets) != 3 {
+				t.Fatal("requested chunks at offsets", offsets, ", expected 3 chunks")
+			}
+		})
+	}
+}
+
+func TestClientRetriesBusyServer(t *testing.T) {
+	_, address := startServer(t, NewMemoryStorage(), Options{MaxConnections: 1})
+	ctx := context.Background()
+	first := client.New(address, client.Options{})
+	if _, err := first.Filenames(ctx); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() {
+		_ = first.Close()
+	})
+	retries := 0
+	second := client.New(address, client.Options{
+		MaxAttempts: 100,
+		RetryDelay:  10 * time.Millisecond,
+		OnRetry: func(err error, attempt int, delay time.Duration) {
+			retries++
+		},
+	})
+	defer second.Close()
+	if _, err := second.Filenames(ctx); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if retries == 0 {
+		t.Fatal("busy server not retried")
+	}
+}
+
+type flakyListener struct {
+	net.Listener
+	remaining int
+	accepted  int32
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if atomic.AddInt32(&ln.accepted, 1) == 1 {
+		return &flakyConn{conn, ln.remaining}, nil
+	}
+	return conn, nil
+}
+
+type flakyConn struct {
+	net.Conn
+	remaining int
+}
+
+func (conn *flakyConn) Write(p []byte) (int, error) {
+	if len(p) <= conn.remaining {
+		n, err := conn.Conn.Write(p)
+		conn.remaining -= n
+		return n, err
+	}
+	n, _ := conn.Conn.Write(p[:conn.remaining])
+	conn.remaining -= n
+	_ = conn.Conn.Close()
+	return n, syscall.ECONNRESET
+}
+
+func TestClientRetriesHelloAfterConnectionLoss(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", []byte("content")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := New(storage, Options{ErrorLog: log.New(ioutil.Discard, "", 0)})
+	go s.Serve(&flakyListener{Listener: ln})
+	defer s.Shutdown(context.Background())
+	netStore := client.New(ln.Addr().String(), client.Options{})
+	defer netStore.Close()
+	fileInfo, err := netStore.Stat(context.Background(), "file")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if fileInfo.ModTime.IsZero() {
+		t.Fatal("connected with protocol version", internal.ProtocolVersion1)
+	}
+}
+
+func TestClientResumesAfterConnectionLoss(t *testing.T) {
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	options := client.Options{Checksum: client.ChecksumNone, DisableCompression: true, MaxAttempts: 3, RetryDelay: time.Millisecond}
+	dataSets := []struct {
+		name string
+		read func(*client.Client) ([]byte, error)
+	}{
+		{"read at", func(netStore *client.Client) ([]byte, error) {
+			buff := make([]byte, len(content))
+			_, err := netStore.ReadAt(context.Background(), "file", 0, buff)
+			return buff, err
+		}},
+		{"read chunk", func(netStore *client.Client) ([]byte, error) {
+			buffer := bytes.NewBuffer(nil)
+			_, err := netStore.ReadChunk(context.Background(), "file", 0, uint64(len(content)), buffer)
+			return buffer.Bytes(), err
+		}},
+		{"download", func(netStore *client.Client) ([]byte, error) {
+			downloaded := path.Join(t.TempDir(), "downloaded")
+			if err := netStore.Download(context.Background(), "file", downloaded); err != nil {
+				return nil, err
+			}
+			return ioutil.ReadFile(downloaded)
+		}},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			flaky := &flakyListener{Listener: ln, remaining: 1000}
+			s := New(storage, Options{ErrorLog: log.New(ioutil.Discard, "", 0)})
+			go s.Serve(flaky)
+			defer s.Shutdown(context.Background())
+			netStore := client.New(ln.Addr().String(), options)
+			defer netStore.Close()
+			received, err := dataSet.read(netStore)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !bytes.Equal(received, content) {
+				t.Fatal("received", len(received), "bytes differing from the file")
+			}
+			if accepted := atomic.LoadInt32(&flaky.accepted); accepted != 2 {
+				t.Fatal("accepted", accepted, "connections, expected 2")
+			}
+		})
+	}
+}
+
+func TestClientDownloadsShortChunksInParallel(t *testing.T) {
+	content := make([]byte, 10000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{MaxChunkSize: 300})
+	netStore := client.New(address, client.Options{ChunkSize: 1000, Parallel: 4})
+	defer netStore.Close()
+	downloaded := path.Join(t.TempDir(), "downloaded")
+	if err := netStore.Download(context.Background(), "file", downloaded); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if received, err := ioutil.ReadFile(downloaded); err != nil || !bytes.Equal(received, content) {
+		t.Fatal("received", len(received), "bytes differing from the file, error:", err)
+	}
+	if _, err := os.Stat(internal.DownloadStatePath(downloaded)); !os.IsNotExist(err) {
+		t.Fatal("download state not removed, error:", err)
+	}
+}
+
+func TestClientResumesFailedParallelDownload(t *testing.T) {
+	content := make([]byte, 10000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	memory := NewMemoryStorage()
+	if err := memory.WriteFile("file", content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage := &recordingStorage{Storage: memory}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := New(storage, Options{MaxChunkSize: 300, ErrorLog: log.New(ioutil.Discard, "", 0)})
+	go s.Serve(&flakyListener{Listener: ln, remaining: 1000})
+	defer s.Shutdown(context.Background())
+	options := client.Options{Checksum: client.ChecksumNone, ChunkSize: 1000, Parallel: 4}
+	netStore := client.New(ln.Addr().String(), options)
+	defer netStore.Close()
+	downloaded := path.Join(t.TempDir(), "downloaded")
+	if err := netStore.Download(context.Background(), "file", downloaded); err == nil {
+		t.Fatal("expected error not returned")
+	}
+	state, err := internal.LoadDownloadState(internal.DownloadStatePath(downloaded))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	missing := state.Missing()
+	if len(missing) == 0 {
+		t.Fatal("no missing ranges in the download state")
+	}
+	storage.reset()
+	if err := netStore.Resume(context.Background(), "file", downloaded); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if received, err := ioutil.ReadFile(downloaded); err != nil || !bytes.Equal(received, content) {
+		t.Fatal("received", len(received), "bytes differing from the file, error:", err)
+	}
+	for _, offset := range storage.reset() {
+		inMissing := false
+		for _, missingRange := range missing {
+			if uint64(offset) >= missingRange.Start && uint64(offset) < missingRange.End {
+				inMissing = true
+			}
+		}
+		if !inMissing {
+			t.Fatal("requested chunk at offset", offset, "outside the missing ranges", missing)
+		}
+	}
+}
+
+func TestClientFile(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", []byte("0123456789")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{})
+	netStore := client.New(address, client.Options{ChunkSize: 4})
+	defer netStore.Close()
+	if _, err := netStore.Open("missing"); !errors.Is(err, client.ErrBadFilename) {
+		t.Fatal("expected error not returned")
+	}
+	file, err := netStore.Open("file")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if file.Name() != "file" || file.Size() != 10 {
+		t.Fatal("opened", file.Name(), "of size", file.Size(), ", expected file of size 10")
+	}
+	var reader io.ReadSeeker = file
+	if offset, err := reader.Seek(-4, io.SeekEnd); err != nil || offset != 6 {
+		t.Fatal("seeked to", offset, "with error", err, ", expected 6")
+	}
+	if received, err := ioutil.ReadAll(reader); err != nil || string(received) != "6789" {
+		t.Fatal("read", string(received), "with error", err, ", expected 6789")
+	}
+	if n, err := reader.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal("read", n, "bytes with error", err, ", expected", io.EOF)
+	}
+	if offset, err := reader.Seek(1, io.SeekStart); err != nil || offset != 1 {
+		t.Fatal("seeked to", offset, "with error", err, ", expected 1")
+	}
+	buff := make([]byte, 6)
+	if _, err := io.ReadFull(reader, buff); err != nil || string(buff) != "123456" {
+		t.Fatal("read", string(buff), "with error", err, ", expected 123456")
+	}
+	if offset, err := reader.Seek(2, io.SeekCurrent); err != nil || offset != 9 {
+		t.Fatal("seeked to", offset, "with error", err, ", expected 9")
+	}
+	if n, err := reader.Read(buff); n != 1 || buff[0] != '9' || err != nil {
+		t.Fatal("read", n, "bytes with error", err, ", expected 9")
+	}
+	if _, err := reader.Seek(-11, io.SeekEnd); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestClientResume(t *testing.T) {
+	content := make([]byte, 10000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{})
+	netStore := client.New(address, client.Options{Checksum: client.ChecksumNone, ChunkSize: 1000})
+	defer netStore.Close()
+	fileInfo, err := netStore.Stat(context.Background(), "file")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	partial := make([]byte, 4000)
+	dataSets := []struct {
+		name     string
+		modTime  time.Time
+		expected []byte
+	}{
+		{"matching state", fileInfo.ModTime, append(append([]byte(nil), partial...), content[len(partial):]...)},
+		{"stale state", fileInfo.ModTime.Add(time.Second), content},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			downloaded := path.Join(t.TempDir(), "downloaded")
+			if err := ioutil.WriteFile(downloaded, partial, 0644); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			state := internal.DownloadState{Size: fileInfo.Size, ModTime: dataSet.modTime.UnixNano()}
+			state.Add(0, uint64(len(partial)))
+			if err := state.Save(internal.DownloadStatePath(downloaded)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if err := netStore.Resume(context.Background(), "file", downloaded); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if received, err := ioutil.ReadFile(downloaded); err != nil || !bytes.Equal(received, dataSet.expected) {
+				t.Fatal("received", len(received), "bytes differing from the expected ones, error:", err)
+			}
+			if _, err := os.Stat(internal.DownloadStatePath(downloaded)); !os.IsNotExist(err) {
+				t.Fatal("download state not removed, error:", err)
+			}
+		})
+	}
+}
+
+func TestClientHash(t *testing.T) {
+	content := bytes.Repeat([]byte("content"), 1000)
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{})
+	dataSets := []struct {
+		name      string
+		checksum  client.Checksum
+		algorithm uint32
+	}{
+		{"crc32c", client.ChecksumCRC32C, internal.CapabilityChecksumCRC32C},
+		{"sha256", client.ChecksumSHA256, internal.CapabilityChecksumSHA256},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			netStore := client.New(address, client.Options{Checksum: dataSet.checksum})
+			defer netStore.Close()
+			expected, err := internal.ReaderChecksum(bytes.NewReader(content), dataSet.algorithm)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if digest, err := netStore.Hash(context.Background(), "file"); err != nil || !bytes.Equal(digest, expected) {
+				t.Fatal("hashed", digest, "with error", err, ", expected", expected)
+			}
+			if _, err := netStore.Hash(context.Background(), "missing"); !errors.Is(err, client.ErrBadFilename) {
+				t.Fatal("expected error not returned")
+			}
+		})
+	}
+	netStore := client.New(address, client.Options{Checksum: client.ChecksumNone})
+	defer netStore.Close()
+	if _, err := netStore.Hash(context.Background(), "file"); !errors.Is(err, client.ErrChecksumsDisabled) {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestServerClosesConnectionAfterFailedAuth(t *testing.T) {
+	credentials := Credentials{"user": []byte("password")}
+	_, address := startServer(t, NewMemoryStorage(), Options{Credentials: credentials, ErrorLog: log.New(ioutil.Discard, "", 0)})
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer conn.Close()
+	if err := internal.WriteAuthRequest(conn, []byte("user")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType, err := internal.ReadResponseType(conn); err != nil || responseType != internal.ResponseTypeChallenge {
+		t.Fatal("read response type", responseType, "with error", err, ", expected challenge")
+	}
+	challenge, err := internal.ReadChallenge(conn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := internal.WriteAuthProof(conn, internal.AuthProof([]byte("wrong"), challenge)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType, err := internal.ReadResponseType(conn); err != nil || responseType != internal.ResponseTypeRefusal {
+		t.Fatal("read response type", responseType, "with error", err, ", expected refusal")
+	}
+	if cause, err := internal.ReadRefusal(conn); err != nil || cause != internal.RefusalCauseAuth {
+		t.Fatal("read refusal cause", cause, "with error", err, ", expected", internal.RefusalCauseAuth)
+	}
+	if err := internal.WriteAuthRequest(conn, []byte("user")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := internal.ReadResponseType(conn); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestServerClosesConnectionAfterUnauthenticatedUpload(t *testing.T) {
+	credentials := Credentials{"user": []byte("password")}
+	options := Options{AllowUploads: true, Credentials: credentials, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	_, address := startServer(t, NewMemoryStorage(), options)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := internal.WriteUploadRequest(conn, 0, 0, math.MaxUint32, []byte("file"), nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if responseType, err := internal.ReadResponseType(conn); err != nil || responseType != internal.ResponseTypeRefusal {
+		t.Fatal("read response type", responseType, "with error", err, ", expected refusal")
+	}
+	if cause, err := internal.ReadRefusal(conn); err != nil || cause != internal.RefusalCauseAuth {
+		t.Fatal("read refusal cause", cause, "with error", err, ", expected", internal.RefusalCauseAuth)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("read with error", err, ", expected", io.EOF)
+	}
+	upload := path.Join(t.TempDir(), "upload")
+	if err := ioutil.WriteFile(upload, make([]byte, 8<<20), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	c := client.New(address, client.Options{})
+	defer c.Close()
+	var refusal *client.RefusalError
+	if err := c.Upload(context.Background(), upload, "file"); !errors.As(err, &refusal) || refusal.Cause != internal.RefusalCauseAuth {
+		t.Fatal("uploaded with error", err, ", expected authentication refusal")
+	}
+}
+
+func TestServerPolicy(t *testing.T) {
+	dir := t.TempDir()
+	policyPath := path.Join(dir, "policy")
+	policyContent := "allow * list,read public\nallow user:alice list,read,write *\nallow user:bob list secret\n"
+	if err := ioutil.WriteFile(policyPath, []byte(policyContent), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	policy, err := LoadPolicy(policyPath)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage := NewMemoryStorage()
+	for _, name := range []string{"public", "secret"} {
+		if err := storage.WriteFile(name, []byte(name)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	upload := path.Join(dir, "upload")
+	if err := ioutil.WriteFile(upload, []byte("upload"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	credentials := Credentials{"alice": []byte("alice password"), "bob": []byte("bob password")}
+	logger := log.New(ioutil.Discard, "", 0)
+	_, address := startServer(t, storage, Options{AllowUploads: true, Credentials: credentials, Policy: policy, ErrorLog: logger})
+	_, unauthenticatedAddress := startServer(t, storage, Options{AllowUploads: true, Policy: policy, ErrorLog: logger})
+	dataSets := []struct {
+		name      string
+		address   string
+		username  string
+		password  string
+		filenames []string
+		read      bool
+		write     bool
+	}{
+		{"anonymous", unauthenticatedAddress, "", "", []string{"public"}, false, false},
+		{"unauthenticated", unauthenticatedAddress, "alice", "wrong", []string{"public"}, false, false},
+		{"bob", address, "bob", "bob password", []string{"public", "secret"}, false, false},
+		{"alice", address, "alice", "alice password", []string{"public", "secret"}, true, true},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := client.New(dataSet.address, client.Options{Username: dataSet.username, Password: dataSet.password})
+			defer c.Close()
+			filenames, err := c.Filenames(ctx)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(filenames) != len(dataSet.filenames) {
+				t.Fatal("listed", filenames, ", expected", dataSet.filenames)
+			}
+			for i, filename := range filenames {
+				if filename != dataSet.filenames[i] {
+					t.Fatal("listed", filenames, ", expected", dataSet.filenames)
+				}
+			}
+			var buff bytes.Buffer
+			if _, err := c.ReadChunk(ctx, "public", 0, 6, &buff); err != nil || buff.String() != "public" {
+				t.Fatal("read", buff.String(), "with error", err, ", expected public")
+			}
+			var refusal *client.RefusalError
+			buff.Reset()
+			_, err = c.ReadChunk(ctx, "secret", 0, 6, &buff)
+			if dataSet.read && (err != nil || buff.String() != "secret") {
+				t.Fatal("read", buff.String(), "with error", err, ", expected secret")
+			} else if !dataSet.read && (!errors.As(err, &refusal) || refusal.Cause != internal.RefusalCauseForbidden) {
+				t.Fatal("read secret with error", err, ", expected forbidden refusal")
+			}
+			err = c.Upload(ctx, upload, "uploaded")
+			if dataSet.write && err != nil {
+				t.Fatal("unexpected error:", err)
+			} else if !dataSet.write && (!errors.As(err, &refusal) || refusal.Cause != internal.RefusalCauseForbidden) {
+				t.Fatal("uploaded with error", err, ", expected forbidden refusal")
+			}
+		})
+	}
+}
+
+func TestServerCompressedChunkSize(t *testing.T) {
+	incompressible := make([]byte, 1<<20)
+	if _, err := rand.Read(incompressible); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("compressible", bytes.Repeat([]byte("compressible "), 100000)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := storage.WriteFile("incompressible", incompressible); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, address := startServer(t, storage, Options{})
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer conn.Close()
+	err = internal.WriteHelloRequest(conn, internal.ProtocolVersion2, internal.ProtocolVersion2, internal.CapabilityCompression)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := internal.ReadResponseType(conn); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := internal.ReadHelloResponse(conn); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dataSets := []struct {
+		filename string
+		encoding uint16
+		size     uint64
+	}{
+		{"compressible", internal.ChunkEncodingGzip, internal.MaxCompressedChunkSize},
+		{"incompressible", internal.ChunkEncodingIdentity, 1 << 20},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.filename, func(t *testing.T) {
+			if err := internal.WriteChunkRequestV2(conn, 0, 1<<20, []byte(dataSet.filename)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if responseType, err := internal.ReadResponseType(conn); err != nil || responseType != internal.ResponseTypeChunk {
+				t.Fatal("read response type", responseType, "with error", err, ", expected chunk")
+			}
+			encoding, err := internal.ReadChunkEncoding(conn)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if encoding != dataSet.encoding {
+				t.Fatal("read encoding", encoding, ", expected", dataSet.encoding)
+			}
+			chunk := bytes.NewBuffer(nil)
+			size, err := internal.ReadChunkResponseV2(conn, chunk, 1<<20)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if encoding == internal.ChunkEncodingGzip {
+				size, err = internal.DecompressChunk(chunk, ioutil.Discard, 1<<20)
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+			}
+			if size != dataSet.size {
+				t.Fatal("received", size, "bytes, expected", dataSet.size)
+			}
+		})
+	}
+}
+
+func TestServerSharedBandwidthLimit(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", make([]byte, 100<<10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	options := Options{WriteTimeout: 300 * time.Millisecond, MinTransferRate: 100 << 10, BandwidthLimit: 100 << 10}
+	_, address := startServer(t, storage, options)
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			netStore := client.New(address, client.Options{DisableCompression: true})
+			defer netStore.Close()
+			_, err := netStore.ReadAt(context.Background(), "file", 0, make([]byte, 100<<10))
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+}
+
+func TestServerLimitsConcurrentRefusals(t *testing.T) {
+	s, address := startServer(t, NewMemoryStorage(), Options{MaxConnections: 1, ErrorLog: log.New(ioutil.Discard, "", 0)})
+	ctx := context.Background()
+	first := client.New(address, client.Options{})
+	defer first.Close()
+	if _, err := first.Filenames(ctx); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for i := 0; i < cap(s.refusals); i++ {
+		s.refusals <- struct{}{}
+	}
+	second := client.New(address, client.Options{})
+	defer second.Close()
+	if _, err := second.Filenames(ctx); !errors.Is(err, client.ErrServerBusy) {
+		t.Fatal("expected error not returned")
+	}
+	if len(s.refusals) != cap(s.refusals) {
+		t.Fatal("refusing", len(s.refusals), "connections, expected", cap(s.refusals))
+	}
+	<-s.refusals
+	if _, err := second.Filenames(ctx); !errors.Is(err, client.ErrServerBusy) {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestServerClientBandwidthLimitAcrossReconnects(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("file", make([]byte, 100<<10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s, address := startServer(t, storage, Options{ClientBandwidthLimit: 100 << 10})
+	options := client.Options{DisableCompression: true}
+	first := client.New(address, options)
+	if _, err := first.ReadAt(context.Background(), "file", 0, make([]byte, 100<<10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for connectionCount(s) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := client.New(address, options)
+	defer second.Close()
+	start := time.Now()
+	if _, err := second.ReadAt(context.Background(), "file", 0, make([]byte, 50<<10)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatal("transferred in", elapsed, ", expected at least 300ms")
+	}
+}
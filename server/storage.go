@@ -0,0 +1,141 @@
+package server
+
+import (
+	"NetStore/internal"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+var ErrInvalidName = errors.New("invalid filename")
+
+type FileInfo struct {
+	Name    string
+	Size    uint64
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+type Storage interface {
+	List() ([]FileInfo, error)
+	Stat(name string) (FileInfo, error)
+	OpenReader(name string, offset int64) (io.ReadCloser, error)
+	OpenWriter(name string, offset int64, truncate bool) (io.WriteCloser, error)
+}
+
+func newFileInfo(fileInfo internal.FileInfo) FileInfo {
+	return FileInfo{string(fileInfo.Name), fileInfo.Size, fileInfo.ModTime, fileInfo.Mode}
+}
+
+func protocolFileInfo(fileInfo FileInfo) internal.FileInfo {
+	return internal.FileInfo{Name: []byte(fileInfo.Name), Size: fileInfo.Size, ModTime: fileInfo.ModTime, Mode: fileInfo.Mode}
+}
+
+type DirStorage struct {
+	index *internal.FileIndex
+}
+
+func NewDirStorage(dir string, recursive bool) (*DirStorage, error) {
+	index, err := internal.NewFileIndex(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+	return &DirStorage{index}, nil
+}
+
+func (storage *DirStorage) Rescan() error {
+	return storage.index.Rescan()
+}
+
+func (storage *DirStorage) List() ([]FileInfo, error) {
+	files := storage.index.Files()
+	listed := make([]FileInfo, 0, len(files))
+	for _, fileInfo := range files {
+		listed = append(listed, newFileInfo(fileInfo))
+	}
+	return listed, nil
+}
+
+func (storage *DirStorage) Stat(name string) (FileInfo, error) {
+	if !storage.index.IsValidName([]byte(name)) {
+		return FileInfo{}, ErrInvalidName
+	}
+	fileInfo, ok, err := storage.index.Refresh([]byte(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !ok {
+		return FileInfo{}, os.ErrNotExist
+	}
+	return newFileInfo(fileInfo), nil
+}
+
+func (storage *DirStorage) OpenReader(name string, offset int64) (io.ReadCloser, error) {
+	if !storage.index.IsValidName([]byte(name)) {
+		return nil, ErrInvalidName
+	}
+	if _, ok, err := storage.index.Refresh([]byte(name)); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, os.ErrNotExist
+	}
+	file, err := internal.OpenFile(path.Join(storage.index.Dir(), name), offset, syscall.O_RDONLY|syscall.O_NOFOLLOW)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, ErrInvalidName
+	} else if os.IsNotExist(err) {
+		storage.index.Remove([]byte(name))
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+type dirWriter struct {
+	*os.File
+	storage *DirStorage
+	name    string
+}
+
+func (writer *dirWriter) Close() error {
+	stat, err := writer.Stat()
+	if err != nil {
+		_ = writer.File.Close()
+		return err
+	}
+	if err := writer.File.Close(); err != nil {
+		return err
+	}
+	writer.storage.index.Update(internal.NewFileInfo([]byte(writer.name), stat))
+	return nil
+}
+
+func (storage *DirStorage) OpenWriter(name string, offset int64, truncate bool) (io.WriteCloser, error) {
+	if ok, err := storage.index.MakeParents([]byte(name)); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrInvalidName
+	}
+	filepath := path.Join(storage.index.Dir(), name)
+	if stat, err := os.Lstat(filepath); err == nil && !stat.Mode().IsRegular() {
+		return nil, ErrInvalidName
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := internal.OpenFile(filepath, offset, os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, ErrInvalidName
+	} else if err != nil {
+		return nil, err
+	}
+	if truncate {
+		if err := file.Truncate(offset); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	return &dirWriter{file, storage, name}, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func readFile(t *testing.T, storage Storage, name string) string {
+	reader, err := storage.OpenReader(name, 0)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return string(content)
+}
+
+func writeFile(t *testing.T, storage Storage, name string, offset int64, truncate bool, content string) {
+	writer, err := storage.OpenWriter(name, offset, truncate)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := io.WriteString(writer, content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("dir/file", []byte("content")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	writeFile(t, storage, "dir/file", 3, false, "TENT and more")
+	writeFile(t, storage, "other", 0, true, "other")
+	writeFile(t, storage, "other", 2, true, "HER")
+	dataSets := []struct {
+		name    string
+		content string
+	}{
+		{"dir/file", "conTENT and more"},
+		{"other", "otHER"},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			if content := readFile(t, storage, dataSet.name); content != dataSet.content {
+				t.Fatal("read", content, ", expected", dataSet.content)
+			}
+			fileInfo, err := storage.Stat(dataSet.name)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if fileInfo.Size != uint64(len(dataSet.content)) {
+				t.Fatal("size", fileInfo.Size, ", expected", len(dataSet.content))
+			}
+		})
+	}
+	files, err := storage.List()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(files) != 2 || files[0].Name != "dir/file" || files[1].Name != "other" {
+		t.Fatal("listed", files, ", expected dir/file and other")
+	}
+}
+
+func TestMemoryStorageInvalidNames(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("dir/file", []byte("content")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dataSets := []string{"", "../file", "dir", "dir/file/nested", "dir//file"}
+	for _, name := range dataSets {
+		t.Run(name, func(t *testing.T) {
+			if _, err := storage.OpenWriter(name, 0, true); !errors.Is(err, ErrInvalidName) {
+				t.Fatal("expected error not returned")
+			}
+		})
+	}
+	if _, err := storage.Stat("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestOverlayStorage(t *testing.T) {
+	upper := NewMemoryStorage()
+	lower, err := NewDirStorage(t.TempDir(), true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	writeFile(t, lower, "shadowed", 0, true, "lower")
+	writeFile(t, lower, "lower", 0, true, "lower")
+	writeFile(t, lower, "appended", 0, true, "lower")
+	writeFile(t, upper, "shadowed", 0, true, "upper")
+	storage, err := NewOverlayStorage(upper, lower)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	writeFile(t, storage, "appended", 5, false, " upper")
+	writeFile(t, storage, "created", 0, true, "upper")
+	dataSets := []struct {
+		name    string
+		content string
+	}{
+		{"shadowed", "upper"},
+		{"lower", "lower"},
+		{"appended", "lower upper"},
+		{"created", "upper"},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			if content := readFile(t, storage, dataSet.name); content != dataSet.content {
+				t.Fatal("read", content, ", expected", dataSet.content)
+			}
+		})
+	}
+	if content := readFile(t, lower, "appended"); content != "lower" {
+		t.Fatal("lower layer modified to", content)
+	}
+	files, err := storage.List()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(files) != 4 {
+		t.Fatal("listed", len(files), "files, expected 4")
+	}
+	if _, err := storage.Stat("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected error not returned")
+	}
+	if _, err := NewOverlayStorage(); err == nil {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestDirStorageInvalidNames(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage, err := NewDirStorage(dir, true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err := storage.OpenWriter("file/nested", 0, true); !errors.Is(err, ErrInvalidName) {
+		t.Fatal("expected error not returned")
+	}
+	if _, err := storage.Stat("../file"); !errors.Is(err, ErrInvalidName) {
+		t.Fatal("expected error not returned")
+	}
+}
+
+func TestDirStorageSymlinks(t *testing.T) {
+	outside := path.Join(t.TempDir(), "outside")
+	if err := ioutil.WriteFile(outside, []byte("outside content"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(outside, path.Join(dir, "link")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := os.Symlink(path.Dir(outside), path.Join(dir, "linkdir")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	storage, err := NewDirStorage(dir, true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	dataSets := []struct {
+		name     string
+		filename string
+		offset   int64
+		truncate bool
+	}{
+		{"truncating link", "link", 0, true},
+		{"appending to link", "link", 0, false},
+		{"link at offset", "link", 7, true},
+		{"through linked directory", "linkdir/outside", 0, true},
+	}
+	for _, dataSet := range dataSets {
+		t.Run(dataSet.name, func(t *testing.T) {
+			if _, err := storage.OpenWriter(dataSet.filename, dataSet.offset, dataSet.truncate); !errors.Is(err, ErrInvalidName) {
+				t.Fatal("expected error not returned")
+			}
+			if _, err := storage.OpenReader(dataSet.filename, 0); !isMissing(err) {
+				t.Fatal("expected error not returned")
+			}
+			content, err := ioutil.ReadFile(outside)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if string(content) != "outside content" {
+				t.Fatal("file outside the root changed to", string(content))
+			}
+		})
+	}
+}